@@ -0,0 +1,402 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v arena_test.go debug_test.go freelist_test.go handles_test.go
+
+const arenaChunkSize = 64 << 10
+
+// Arena hands out memory for many small values from large chunks and
+// releases all of it at once. Chunks are allocated as []uint64, so the Go
+// garbage collector never scans them: values containing Go pointers are
+// rejected, otherwise the objects they point to could be collected while
+// still referenced from the arena.
+//
+// In debug mode (see SetDebug) unused memory is poisoned and every value is
+// followed by debugGuardSize guard bytes.
+type Arena struct {
+	chunks [][]byte
+	large  [][]byte
+	chunk  int
+	offset int
+	freed  bool
+	debug  bool
+	blocks []arenaBlock // values allocated since Reset, in debug mode
+}
+
+type arenaBlock struct {
+	chunk []byte
+	span  Span
+}
+
+var zeroSized struct{}
+
+// pointerTypes caches hasPointers by reflect.Type.
+var pointerTypes sync.Map
+
+func NewArena() *Arena {
+	return &Arena{debug: debug.Load()}
+}
+
+// New returns a zeroed T allocated in the arena, it panics if T contains Go
+// pointers.
+func New[T any](a *Arena) *T {
+	var zero T
+	checkPointerFree(reflect.TypeFor[T]())
+
+	ptr := a.alloc(int(unsafe.Sizeof(zero)), int(unsafe.Alignof(zero)))
+	return (*T)(ptr)
+}
+
+// MakeSlice returns a zeroed []T of length and capacity n allocated in the
+// arena, it panics if T contains Go pointers or the size of n values of T
+// overflows int.
+func MakeSlice[T any](a *Arena, n int) []T {
+	var zero T
+	checkPointerFree(reflect.TypeFor[T]())
+
+	size := int(unsafe.Sizeof(zero))
+	if n < 0 {
+		panic("negative slice length")
+	}
+	// leave room for the offset in a chunk and the guard bytes
+	if size > 0 && n > (math.MaxInt-arenaChunkSize-debugGuardSize)/size {
+		panic("slice length too large")
+	}
+	if n == 0 {
+		return []T{}
+	}
+
+	ptr := a.alloc(size*n, int(unsafe.Alignof(zero)))
+	return unsafe.Slice((*T)(ptr), n)
+}
+
+// Reset makes all memory of the arena available again. Values allocated
+// before Reset must not be used afterwards.
+func (a *Arena) Reset() {
+	a.checkFreed()
+
+	for _, chunk := range a.chunks[:min(a.chunk+1, len(a.chunks))] {
+		scrub(chunk, a.debug)
+	}
+	a.large = nil
+	a.blocks = nil
+	a.chunk = 0
+	a.offset = 0
+}
+
+// Free releases all chunks, the arena cannot be used afterwards.
+func (a *Arena) Free() {
+	a.checkFreed()
+
+	a.chunks = nil
+	a.large = nil
+	a.blocks = nil
+	a.freed = true
+}
+
+// Allocated returns the number of bytes held in chunks.
+func (a *Arena) Allocated() int {
+	total := len(a.chunks) * arenaChunkSize
+	for _, chunk := range a.large {
+		total += len(chunk)
+	}
+	return total
+}
+
+func (a *Arena) alloc(size, align int) unsafe.Pointer {
+	a.checkFreed()
+
+	if size == 0 {
+		return unsafe.Pointer(&zeroSized)
+	}
+
+	length := size
+	if a.debug {
+		length += debugGuardSize
+	}
+
+	if length > arenaChunkSize/4 {
+		// large values get a dedicated chunk, so they do not waste the rest of
+		// the current one
+		chunk := alignedMemory(length)
+		a.large = append(a.large, chunk)
+		return a.block(chunk, 0, size)
+	}
+
+	for ; a.chunk < len(a.chunks); a.chunk, a.offset = a.chunk+1, 0 {
+		chunk := a.chunks[a.chunk]
+		offset := alignOffset(uintptr(unsafe.Pointer(&chunk[0])), a.offset, align)
+		if offset+length <= len(chunk) {
+			a.offset = offset + length
+			return a.block(chunk, offset, size)
+		}
+	}
+
+	chunk := alignedMemory(arenaChunkSize)
+	if a.debug {
+		poison(chunk)
+	}
+	a.chunks = append(a.chunks, chunk)
+	a.chunk = len(a.chunks) - 1
+	a.offset = length
+	return a.block(chunk, 0, size)
+}
+
+// block returns the address of size bytes at offset in chunk, in debug mode
+// it also guards them.
+func (a *Arena) block(chunk []byte, offset, size int) unsafe.Pointer {
+	if a.debug {
+		a.blocks = append(a.blocks, arenaBlock{chunk: chunk, span: guardValue(chunk, offset, size)})
+	}
+	return unsafe.Pointer(&chunk[offset])
+}
+
+// Verify checks the guard bytes of every value allocated since the last
+// Reset and that the unused rest of the chunks is still poisoned. Offsets in
+// the *CorruptionError it returns are relative to the chunk. Without debug
+// mode there is nothing to verify.
+func (a *Arena) Verify() error {
+	a.checkFreed()
+	if !a.debug {
+		return nil
+	}
+
+	for _, block := range a.blocks {
+		if err := verifyGuardedValue(block.chunk, block.span); err != nil {
+			return err
+		}
+	}
+
+	for i := a.chunk; i < len(a.chunks); i++ {
+		unused := Span{Size: arenaChunkSize}
+		if i == a.chunk {
+			unused = Span{Offset: a.offset, Size: arenaChunkSize - a.offset}
+		}
+		if j := mismatch(a.chunks[i][unused.Offset:unused.End()], poisonByte); j != -1 {
+			return &CorruptionError{Block: unused, Offset: unused.Offset + j, Reason: "write after free"}
+		}
+	}
+	return nil
+}
+
+func (a *Arena) checkFreed() {
+	if a.freed {
+		panic("arena is freed")
+	}
+}
+
+func checkPointerFree(t reflect.Type) {
+	if cached, ok := pointerTypes.Load(t); ok {
+		if cached.(bool) {
+			panic("arena: " + t.String() + " contains Go pointers")
+		}
+		return
+	}
+
+	result := hasPointers(t)
+	pointerTypes.Store(t, result)
+	if result {
+		panic("arena: " + t.String() + " contains Go pointers")
+	}
+}
+
+func hasPointers(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.UnsafePointer, reflect.Map, reflect.Slice, reflect.String,
+		reflect.Chan, reflect.Func, reflect.Interface:
+		return true
+	case reflect.Array:
+		return t.Len() > 0 && hasPointers(t.Elem())
+	case reflect.Struct:
+		for i := range t.NumField() {
+			if hasPointers(t.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+type arenaPoint struct {
+	X, Y  int32
+	Flags [3]byte
+	Value float64
+}
+
+func TestArenaNew(t *testing.T) {
+	a := NewArena()
+
+	b := New[byte](a)
+	point := New[arenaPoint](a)
+	number := New[int64](a)
+
+	*b = 0xFF
+	point.X, point.Y, point.Value = 1, 2, 3.5
+	*number = -1
+
+	assert.Equal(t, byte(0xFF), *b)
+	assert.Equal(t, arenaPoint{X: 1, Y: 2, Value: 3.5}, *point)
+	assert.Equal(t, int64(-1), *number)
+
+	assert.Zero(t, uintptr(unsafe.Pointer(point))%unsafe.Alignof(arenaPoint{}))
+	assert.Zero(t, uintptr(unsafe.Pointer(number))%unsafe.Alignof(int64(0)))
+	assert.Equal(t, arenaChunkSize, a.Allocated())
+
+	empty := New[struct{}](a)
+	assert.NotNil(t, empty)
+}
+
+func TestArenaRejectsPointers(t *testing.T) {
+	a := NewArena()
+
+	tests := map[string]func(){
+		"pointer":          func() { New[*int](a) },
+		"string":           func() { New[string](a) },
+		"slice":            func() { MakeSlice[[]byte](a, 1) },
+		"map":              func() { New[map[int]int](a) },
+		"interface":        func() { New[any](a) },
+		"unsafe pointer":   func() { New[unsafe.Pointer](a) },
+		"struct field":     func() { New[struct{ name string }](a) },
+		"array element":    func() { New[[2]*int](a) },
+		"nested structure": func() { New[struct{ inner struct{ f func() } }](a) },
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Panics(t, test)
+		})
+	}
+
+	assert.NotPanics(t, func() { New[[0]*int](a) })
+	assert.NotPanics(t, func() { New[struct{ a [4]uint16 }](a) })
+}
+
+func TestArenaMakeSlice(t *testing.T) {
+	a := NewArena()
+
+	small := MakeSlice[uint32](a, 10)
+	assert.Len(t, small, 10)
+	assert.Equal(t, 10, cap(small))
+	for i := range small {
+		small[i] = uint32(i)
+	}
+
+	// values larger than a quarter of a chunk get their own chunk
+	large := MakeSlice[uint64](a, arenaChunkSize/8)
+	large[len(large)-1] = 42
+	assert.Equal(t, 2*arenaChunkSize, a.Allocated())
+
+	next := MakeSlice[uint32](a, 1)
+	assert.Equal(t, uintptr(unsafe.Pointer(&small[9]))+4, uintptr(unsafe.Pointer(&next[0])))
+
+	assert.Equal(t, []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, small)
+	assert.Equal(t, uint64(42), large[len(large)-1])
+	assert.Empty(t, MakeSlice[uint32](a, 0))
+	assert.Panics(t, func() { MakeSlice[uint32](a, -1) })
+	assert.Panics(t, func() { MakeSlice[uint64](a, math.MaxInt/4) })
+	assert.Panics(t, func() { MakeSlice[[1 << 20]byte](a, math.MaxInt>>20) })
+	assert.Len(t, MakeSlice[struct{}](a, math.MaxInt), math.MaxInt)
+}
+
+func TestArenaReset(t *testing.T) {
+	a := NewArena()
+
+	first := New[uint64](a)
+	*first = 7
+	for range arenaChunkSize / 1024 {
+		MakeSlice[byte](a, 1024)
+	}
+	MakeSlice[byte](a, arenaChunkSize)
+	assert.Equal(t, 3*arenaChunkSize, a.Allocated())
+
+	a.Reset()
+	assert.Equal(t, 2*arenaChunkSize, a.Allocated())
+
+	again := New[uint64](a)
+	assert.Equal(t, first, again)
+	assert.Zero(t, *again)
+
+	a.Free()
+	assert.Zero(t, a.Allocated())
+	assert.Panics(t, func() { New[uint64](a) })
+	assert.Panics(t, func() { a.Reset() })
+}
+
+type arenaRecord struct {
+	ID    uint64
+	Start int64
+	End   int64
+	Kind  [8]byte
+}
+
+var arenaSink *arenaRecord
+
+func BenchmarkArena(b *testing.B) {
+	b.Run("arena", func(b *testing.B) {
+		b.ReportAllocs()
+		a := NewArena()
+		for i := 0; i < b.N; i++ {
+			for j := range 1000 {
+				arenaSink = New[arenaRecord](a)
+				arenaSink.ID = uint64(j)
+			}
+			a.Reset()
+		}
+	})
+
+	b.Run("heap", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := range 1000 {
+				arenaSink = &arenaRecord{}
+				arenaSink.ID = uint64(j)
+			}
+		}
+	})
+}
+
+func TestArenaDebugReset(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	a := NewArena()
+	first := MakeSlice[byte](a, 16)
+	copy(first, "stale contents!!")
+
+	a.Reset()
+	assert.Equal(t, byte(poisonByte), first[0])
+
+	// reused memory is zeroed again when it is handed out
+	again := MakeSlice[byte](a, 16)
+	assert.Equal(t, make([]byte, 16), again)
+}
+
+func TestArenaDebugGuards(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	a := NewArena()
+	first := MakeSlice[byte](a, 10)
+	second := New[int64](a)
+	assert.Equal(t, unsafe.Pointer(&first[0]), unsafe.Add(unsafe.Pointer(second), -32))
+	assert.NoError(t, a.Verify())
+
+	guarded := unsafe.Slice(&first[0], 26)
+	guarded[10] = 0
+	assert.Equal(t, &CorruptionError{Block: Span{Offset: 0, Size: 26}, Offset: 10, Reason: "back guard overwritten"}, a.Verify())
+	guarded[10] = canaryByte
+
+	a.Reset()
+	assert.NoError(t, a.Verify())
+	first[3] = 1
+	assert.Equal(t, &CorruptionError{Block: Span{Offset: 0, Size: arenaChunkSize}, Offset: 3, Reason: "write after free"}, a.Verify())
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math/bits"
+	"slices"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v buddy_test.go freelist_test.go debug_test.go handles_test.go
+
+// Buddy is a binary buddy allocator. Blocks of order k are 1<<k bytes long
+// and start at a multiple of their size, so the buddy of a block is found by
+// flipping bit k of its offset.
+//
+// In debug mode (see SetDebug) free blocks are poisoned and every block ends
+// with at least debugGuardSize guard bytes. Blocks must stay aligned to their
+// size, so there is no front guard.
+type Buddy struct {
+	memory    []byte
+	minOrder  int
+	maxOrder  int
+	free      []buddyList
+	allocated map[int]buddyBlock
+	debug     bool
+}
+
+type buddyBlock struct {
+	order int
+	size  int
+}
+
+// buddyList is a stack of free block offsets with O(1) removal of any block.
+type buddyList struct {
+	offsets []int
+	index   map[int]int
+}
+
+func (l *buddyList) push(offset int) {
+	l.index[offset] = len(l.offsets)
+	l.offsets = append(l.offsets, offset)
+}
+
+func (l *buddyList) pop() (int, bool) {
+	if len(l.offsets) == 0 {
+		return 0, false
+	}
+
+	offset := l.offsets[len(l.offsets)-1]
+	l.remove(offset)
+	return offset, true
+}
+
+func (l *buddyList) remove(offset int) bool {
+	i, ok := l.index[offset]
+	if !ok {
+		return false
+	}
+
+	last := l.offsets[len(l.offsets)-1]
+	l.offsets[i] = last
+	l.index[last] = i
+	l.offsets = l.offsets[:len(l.offsets)-1]
+	delete(l.index, offset)
+	return true
+}
+
+// NewBuddy manages memory whose length must be a power of two and at least
+// minBlock bytes, minBlock must be a power of two as well.
+func NewBuddy(memory []byte, minBlock int) *Buddy {
+	if !isPowerOfTwo(len(memory)) || !isPowerOfTwo(minBlock) || minBlock > len(memory) {
+		panic("memory and block sizes must be powers of two")
+	}
+
+	b := &Buddy{
+		memory:    memory,
+		minOrder:  bits.TrailingZeros(uint(minBlock)),
+		maxOrder:  bits.TrailingZeros(uint(len(memory))),
+		allocated: map[int]buddyBlock{},
+		debug:     debug.Load(),
+	}
+	if b.debug {
+		poison(memory)
+	}
+
+	b.free = make([]buddyList, b.maxOrder+1)
+	for order := range b.free {
+		b.free[order].index = map[int]int{}
+	}
+	b.free[b.maxOrder].push(0)
+
+	return b
+}
+
+func (b *Buddy) Alloc(size, align int) (unsafe.Pointer, error) {
+	if size <= 0 || !isPowerOfTwo(align) {
+		return nil, ErrInvalidSize
+	}
+	if size > len(b.memory) {
+		// as in the other allocators, and keeps length below from overflowing
+		return nil, ErrOutOfMemory
+	}
+	if uintptr(unsafe.Pointer(&b.memory[0]))%uintptr(align) != 0 {
+		return nil, ErrInvalidSize
+	}
+
+	length := size
+	if b.debug {
+		length += debugGuardSize
+	}
+
+	order := max(b.minOrder, bits.Len(uint(length-1)), bits.TrailingZeros(uint(align)))
+	if order > b.maxOrder {
+		// the block with its guard bytes or alignment exceeds the region
+		return nil, ErrOutOfMemory
+	}
+
+	current := order
+	for current <= b.maxOrder && len(b.free[current].offsets) == 0 {
+		current++
+	}
+	if current > b.maxOrder {
+		return nil, ErrOutOfMemory
+	}
+
+	offset, _ := b.free[current].pop()
+	for current > order {
+		current--
+		b.free[current].push(offset + 1<<current)
+	}
+
+	if b.debug {
+		guard(b.memory[offset+size : offset+1<<order])
+	}
+
+	b.allocated[offset] = buddyBlock{order: order, size: size}
+	return unsafe.Pointer(&b.memory[offset]), nil
+}
+
+// Free releases the block at ptr. In debug mode the guard bytes are verified
+// first and a *CorruptionError is returned without releasing the block if
+// they were overwritten.
+func (b *Buddy) Free(ptr unsafe.Pointer) error {
+	if ptr == nil {
+		return ErrInvalidPointer
+	}
+
+	offset := int(uintptr(ptr) - uintptr(unsafe.Pointer(&b.memory[0])))
+	block, ok := b.allocated[offset]
+	if !ok {
+		return ErrInvalidPointer
+	}
+
+	order := block.order
+	if b.debug {
+		if err := b.verifyBlock(offset, block); err != nil {
+			return err
+		}
+		poison(b.memory[offset : offset+1<<order])
+	}
+	delete(b.allocated, offset)
+
+	for order < b.maxOrder && b.free[order].remove(offset^1<<order) {
+		offset &^= 1 << order
+		order++
+	}
+	b.free[order].push(offset)
+
+	return nil
+}
+
+// Verify checks the guard bytes of every block and that free blocks are
+// still poisoned. It reports the first corruption found in address order.
+// Without debug mode there is nothing to verify.
+func (b *Buddy) Verify() error {
+	if !b.debug {
+		return nil
+	}
+
+	var spans []Span
+	for offset, block := range b.allocated {
+		spans = append(spans, Span{Offset: offset, Size: 1 << block.order})
+	}
+	for order := b.minOrder; order <= b.maxOrder; order++ {
+		for _, offset := range b.free[order].offsets {
+			spans = append(spans, Span{Offset: offset, Size: 1 << order})
+		}
+	}
+	slices.SortFunc(spans, func(a, b Span) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+
+	for _, span := range spans {
+		block, ok := b.allocated[span.Offset]
+		if !ok {
+			if i := mismatch(b.memory[span.Offset:span.End()], poisonByte); i != -1 {
+				return &CorruptionError{Block: span, Offset: span.Offset + i, Reason: "write after free"}
+			}
+			continue
+		}
+
+		if err := b.verifyBlock(span.Offset, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Buddy) verifyBlock(offset int, block buddyBlock) error {
+	span := Span{Offset: offset, Size: 1 << block.order}
+	end := offset + block.size
+	if i := mismatch(b.memory[end:span.End()], canaryByte); i != -1 {
+		return &CorruptionError{Block: span, Offset: end + i, Reason: "back guard overwritten"}
+	}
+	return nil
+}
+
+// FreeBlocks returns the sorted offsets of free blocks of the given order.
+func (b *Buddy) FreeBlocks(order int) []int {
+	if order < b.minOrder || order > b.maxOrder {
+		return nil
+	}
+	return slices.Sorted(slices.Values(b.free[order].offsets))
+}
+
+// Dump describes the free lists from the smallest to the largest order.
+func (b *Buddy) Dump() string {
+	sb := strings.Builder{}
+	for order := b.minOrder; order <= b.maxOrder; order++ {
+		fmt.Fprintf(&sb, "order %d (%d bytes):", order, 1<<order)
+		for _, offset := range b.FreeBlocks(order) {
+			fmt.Fprintf(&sb, " %#x", offset)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func (b *Buddy) Stats() Stats {
+	stats := Stats{
+		Size:        len(b.memory),
+		Allocations: len(b.allocated),
+	}
+
+	for order := b.minOrder; order <= b.maxOrder; order++ {
+		blocks := len(b.free[order].offsets)
+		stats.FreeSpans += blocks
+		stats.Free += blocks << order
+		if blocks > 0 {
+			stats.LargestFree = 1 << order
+		}
+	}
+	stats.Used = stats.Size - stats.Free
+
+	return stats
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+func TestBuddy(t *testing.T) {
+	memory := alignedMemory(128)
+	b := NewBuddy(memory, 16)
+
+	p1, err := b.Alloc(10, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[0]), p1)
+	assert.Equal(t, []int{0x10}, b.FreeBlocks(4))
+	assert.Equal(t, []int{0x20}, b.FreeBlocks(5))
+	assert.Equal(t, []int{0x40}, b.FreeBlocks(6))
+
+	p2, err := b.Alloc(32, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[0x20]), p2)
+
+	p3, err := b.Alloc(33, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[0x40]), p3)
+
+	assert.Equal(t, "order 4 (16 bytes): 0x10\n"+
+		"order 5 (32 bytes):\n"+
+		"order 6 (64 bytes):\n"+
+		"order 7 (128 bytes):\n", b.Dump())
+
+	_, err = b.Alloc(32, 1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = b.Alloc(256, 1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = b.Alloc(0, 1)
+	assert.ErrorIs(t, err, ErrInvalidSize)
+	_, err = b.Alloc(8, 3)
+	assert.ErrorIs(t, err, ErrInvalidSize)
+
+	assert.Equal(t, Stats{
+		Size: 128, Used: 112, Free: 16, Allocations: 3, FreeSpans: 1, LargestFree: 16,
+	}, b.Stats())
+
+	// buddies merge back into the whole region
+	assert.NoError(t, b.Free(p1))
+	assert.Equal(t, []int{0x00}, b.FreeBlocks(5))
+	assert.NoError(t, b.Free(p3))
+	assert.Equal(t, []int{0x40}, b.FreeBlocks(6))
+	assert.NoError(t, b.Free(p2))
+	assert.Equal(t, "order 4 (16 bytes):\n"+
+		"order 5 (32 bytes):\n"+
+		"order 6 (64 bytes):\n"+
+		"order 7 (128 bytes): 0x0\n", b.Dump())
+
+	assert.ErrorIs(t, b.Free(p2), ErrInvalidPointer)
+	assert.ErrorIs(t, b.Free(unsafe.Pointer(&memory[1])), ErrInvalidPointer)
+}
+
+func TestBuddyAlignment(t *testing.T) {
+	memory := alignedMemory(256)
+	b := NewBuddy(memory, 16)
+
+	small, err := b.Alloc(1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[0]), small)
+
+	// alignment raises the order of the block
+	aligned, err := b.Alloc(8, 64)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[64]), aligned)
+}
+
+func TestNewBuddyPanics(t *testing.T) {
+	assert.Panics(t, func() { NewBuddy(make([]byte, 100), 16) })
+	assert.Panics(t, func() { NewBuddy(make([]byte, 128), 24) })
+	assert.Panics(t, func() { NewBuddy(make([]byte, 128), 256) })
+}
+
+func TestBuddyDebugPoison(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	memory := alignedMemory(64)
+	b := NewBuddy(memory, 16)
+	assert.Equal(t, -1, mismatch(memory, poisonByte))
+
+	// the guard bytes make the block one order larger
+	ptr, err := b.Alloc(10, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0x20}, b.FreeBlocks(5))
+	assert.Equal(t, -1, mismatch(memory[10:32], canaryByte))
+	copy(unsafe.Slice((*byte)(ptr), 10), "0123456789")
+	assert.NoError(t, b.Verify())
+
+	assert.NoError(t, b.Free(ptr))
+	assert.Equal(t, -1, mismatch(memory, poisonByte))
+	assert.NoError(t, b.Verify())
+}
+
+func TestBuddyDebugGuards(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	memory := alignedMemory(64)
+	b := NewBuddy(memory, 16)
+	ptr, err := b.Alloc(10, 1)
+	assert.NoError(t, err)
+
+	memory[10] = 0
+	corruption := &CorruptionError{Block: Span{Offset: 0, Size: 32}, Offset: 10, Reason: "back guard overwritten"}
+	assert.Equal(t, corruption, b.Verify())
+	assert.ErrorIs(t, b.Free(ptr), ErrCorrupted)
+	assert.Equal(t, 1, b.Stats().Allocations)
+
+	memory[10] = canaryByte
+	assert.NoError(t, b.Free(ptr))
+
+	*(*byte)(ptr) = 1
+	assert.Equal(t, &CorruptionError{Block: Span{Offset: 0, Size: 64}, Offset: 0, Reason: "write after free"}, b.Verify())
+}
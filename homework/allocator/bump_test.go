@@ -0,0 +1,371 @@
+package main
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v bump_test.go buddy_test.go debug_test.go freelist_test.go handles_test.go
+
+// BumpAllocator shares a region between workers. Each worker takes a chunk
+// of the region by advancing a shared top with compare-and-swap and then
+// allocates from it by bumping an offset, without any synchronization.
+// Memory is only released all at once by Reset.
+//
+// In debug mode (see SetDebug) unused memory is poisoned and every value is
+// followed by debugGuardSize guard bytes.
+type BumpAllocator struct {
+	memory []byte
+	chunk  int
+	top    atomic.Int64
+	epoch  atomic.Uint64
+	debug  bool
+}
+
+// BumpWorker allocates from the chunk it owns and must be used by one
+// goroutine at a time.
+type BumpWorker struct {
+	allocator *BumpAllocator
+	epoch     uint64
+	offset    int
+	end       int
+	blocks    []Span // values allocated in the epoch, in debug mode
+}
+
+func NewBumpAllocator(memory []byte, chunk int) *BumpAllocator {
+	if chunk <= 0 {
+		panic("chunk size must be positive")
+	}
+	b := &BumpAllocator{memory: memory, chunk: chunk, debug: debug.Load()}
+	if b.debug {
+		poison(memory)
+	}
+	return b
+}
+
+func (b *BumpAllocator) NewWorker() *BumpWorker {
+	return &BumpWorker{allocator: b, epoch: b.epoch.Load()}
+}
+
+// Reset makes the whole region available again and starts a new epoch, in
+// which workers drop the chunks they took before. It must not run
+// concurrently with Alloc, and memory allocated before must not be used
+// afterwards.
+func (b *BumpAllocator) Reset() {
+	scrub(b.memory[:b.top.Load()], b.debug)
+
+	b.top.Store(0)
+	b.epoch.Add(1)
+}
+
+func (b *BumpAllocator) Epoch() uint64 {
+	return b.epoch.Load()
+}
+
+// Used returns the bytes taken by chunks in the current epoch.
+func (b *BumpAllocator) Used() int {
+	return int(b.top.Load())
+}
+
+// take reserves size bytes of the region and returns their offset. A plain
+// atomic add would move the top past the region on a request that does not
+// fit, and until it is rolled back every other request fails too, even one
+// that fits. The compare-and-swap only moves the top when the bytes fit, so
+// a failed request leaves the rest of the region to smaller ones.
+func (b *BumpAllocator) take(size int) (int, bool) {
+	for {
+		top := b.top.Load()
+		end := top + int64(size)
+		if end > int64(len(b.memory)) {
+			return 0, false
+		}
+		if b.top.CompareAndSwap(top, end) {
+			return int(top), true
+		}
+	}
+}
+
+func (w *BumpWorker) Alloc(size, align int) (unsafe.Pointer, error) {
+	if size <= 0 || !isPowerOfTwo(align) {
+		return nil, ErrInvalidSize
+	}
+
+	b := w.allocator
+	if size > len(b.memory) || align > len(b.memory) {
+		// also keeps the sums below from overflowing
+		return nil, ErrOutOfMemory
+	}
+	if epoch := b.epoch.Load(); epoch != w.epoch {
+		w.epoch, w.offset, w.end, w.blocks = epoch, 0, 0, nil
+	}
+
+	length := size
+	if b.debug {
+		length += debugGuardSize
+	}
+
+	base := uintptr(unsafe.Pointer(unsafe.SliceData(b.memory)))
+	offset := alignOffset(base, w.offset, align)
+	if offset+length > w.end {
+		// the rest of the current chunk is wasted
+		taken := b.chunk
+		if length+align-1 > taken {
+			// large values get a run of chunks of their own
+			taken = (length + align - 1 + b.chunk - 1) / b.chunk * b.chunk
+		}
+
+		start, ok := b.take(taken)
+		if !ok {
+			return nil, ErrOutOfMemory
+		}
+		w.offset, w.end = start, start+taken
+		offset = alignOffset(base, w.offset, align)
+	}
+
+	w.offset = offset + length
+	if b.debug {
+		w.blocks = append(w.blocks, guardValue(b.memory, offset, size))
+	}
+	return unsafe.Pointer(&b.memory[offset]), nil
+}
+
+// Verify checks the guard bytes of the values the worker allocated in the
+// current epoch and that the rest of its chunk is still poisoned. Without
+// debug mode there is nothing to verify.
+func (w *BumpWorker) Verify() error {
+	b := w.allocator
+	if !b.debug || w.epoch != b.epoch.Load() {
+		return nil
+	}
+
+	for _, block := range w.blocks {
+		if err := verifyGuardedValue(b.memory, block); err != nil {
+			return err
+		}
+	}
+
+	unused := Span{Offset: w.offset, Size: w.end - w.offset}
+	if i := mismatch(b.memory[unused.Offset:unused.End()], poisonByte); i != -1 {
+		return &CorruptionError{Block: unused, Offset: unused.Offset + i, Reason: "write after free"}
+	}
+	return nil
+}
+
+func TestBumpAllocator(t *testing.T) {
+	memory := alignedMemory(256)
+	b := NewBumpAllocator(memory, 64)
+	w := b.NewWorker()
+
+	first, err := w.Alloc(10, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[0]), first)
+
+	second, err := w.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[16]), second)
+	assert.Equal(t, 64, b.Used())
+
+	// a value that does not fit the chunk takes the next one
+	third, err := w.Alloc(48, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[64]), third)
+
+	// values larger than a chunk take a run of chunks
+	large, err := w.Alloc(100, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[128]), large)
+	assert.Equal(t, 256, b.Used())
+
+	_, err = w.Alloc(32, 1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = w.Alloc(math.MaxInt-8, 8)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = w.Alloc(8, 1<<62)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = w.Alloc(0, 1)
+	assert.ErrorIs(t, err, ErrInvalidSize)
+	_, err = w.Alloc(8, 3)
+	assert.ErrorIs(t, err, ErrInvalidSize)
+}
+
+func TestBumpAllocatorFailedTake(t *testing.T) {
+	memory := alignedMemory(256)
+	b := NewBumpAllocator(memory, 64)
+	w := b.NewWorker()
+
+	_, err := w.Alloc(64, 1)
+	assert.NoError(t, err)
+
+	// the request fails without taking the chunks that are left
+	_, err = w.Alloc(250, 1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	assert.Equal(t, 64, b.Used())
+
+	other := b.NewWorker()
+	ptr, err := other.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[64]), ptr)
+	assert.Equal(t, 128, b.Used())
+}
+
+func TestBumpAllocatorReset(t *testing.T) {
+	memory := alignedMemory(128)
+	b := NewBumpAllocator(memory, 64)
+	w := b.NewWorker()
+
+	ptr, err := w.Alloc(8, 8)
+	assert.NoError(t, err)
+	*(*uint64)(ptr) = 42
+
+	b.Reset()
+	assert.Equal(t, uint64(1), b.Epoch())
+	assert.Zero(t, b.Used())
+
+	// the worker drops its chunk of the previous epoch
+	other := b.NewWorker()
+	otherPtr, err := other.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, ptr, otherPtr)
+	assert.Zero(t, *(*uint64)(otherPtr))
+
+	again, err := w.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[64]), again)
+}
+
+func TestBumpAllocatorDebug(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	memory := alignedMemory(256)
+	b := NewBumpAllocator(memory, 64)
+	w := b.NewWorker()
+
+	ptr, err := w.Alloc(10, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, 10), memory[:10])
+	assert.Equal(t, -1, mismatch(memory[10:26], canaryByte))
+	assert.Equal(t, -1, mismatch(memory[26:], poisonByte))
+	assert.NoError(t, w.Verify())
+
+	memory[10] = 0
+	assert.Equal(t, &CorruptionError{Block: Span{Offset: 0, Size: 26}, Offset: 10, Reason: "back guard overwritten"}, w.Verify())
+	memory[10] = canaryByte
+
+	memory[30] = 0
+	assert.Equal(t, &CorruptionError{Block: Span{Offset: 26, Size: 38}, Offset: 30, Reason: "write after free"}, w.Verify())
+
+	b.Reset()
+	assert.Equal(t, byte(poisonByte), *(*byte)(ptr))
+	assert.NoError(t, w.Verify())
+}
+
+func TestBumpAllocatorConcurrent(t *testing.T) {
+	const workers, records = 8, 1000
+
+	memory := alignedMemory(workers * records * 16 * 2)
+	b := NewBumpAllocator(memory, 1024)
+
+	results := make([][]*[2]uint64, workers)
+	wg := sync.WaitGroup{}
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := b.NewWorker()
+			for j := range records {
+				ptr, err := w.Alloc(16, 8)
+				if err != nil {
+					return
+				}
+				record := (*[2]uint64)(ptr)
+				record[0], record[1] = uint64(i), uint64(j)
+				results[i] = append(results[i], record)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// records of different workers never overlap
+	for i, result := range results {
+		assert.Len(t, result, records)
+		for j, record := range result {
+			assert.Equal(t, [2]uint64{uint64(i), uint64(j)}, *record)
+		}
+	}
+}
+
+type bumpRecord struct {
+	ID    uint64
+	Start int64
+	End   int64
+	Kind  [8]byte
+}
+
+var bumpSink *bumpRecord
+
+// benchmarkWorkers runs work on every processor and waits for it.
+func benchmarkWorkers(work func()) {
+	wg := sync.WaitGroup{}
+	for range runtime.GOMAXPROCS(0) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work()
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkBumpAllocator(b *testing.B) {
+	const records = 1000
+	size, align := int(unsafe.Sizeof(bumpRecord{})), int(unsafe.Alignof(bumpRecord{}))
+
+	b.Run("bump", func(b *testing.B) {
+		b.ReportAllocs()
+		allocator := NewBumpAllocator(alignedMemory(runtime.GOMAXPROCS(0)*records*size*2), 16<<10)
+		for i := 0; i < b.N; i++ {
+			benchmarkWorkers(func() {
+				w := allocator.NewWorker()
+				for j := range records {
+					ptr, _ := w.Alloc(size, align)
+					(*bumpRecord)(ptr).ID = uint64(j)
+				}
+			})
+			allocator.Reset()
+		}
+	})
+
+	b.Run("sync.Pool", func(b *testing.B) {
+		b.ReportAllocs()
+		pool := sync.Pool{New: func() any { return &bumpRecord{} }}
+		for i := 0; i < b.N; i++ {
+			benchmarkWorkers(func() {
+				batch := make([]*bumpRecord, records)
+				for j := range batch {
+					batch[j] = pool.Get().(*bumpRecord)
+					batch[j].ID = uint64(j)
+				}
+				for _, record := range batch {
+					pool.Put(record)
+				}
+			})
+		}
+	})
+
+	b.Run("heap", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			benchmarkWorkers(func() {
+				for j := range records {
+					bumpSink = &bumpRecord{ID: uint64(j)}
+				}
+			})
+		}
+	})
+}
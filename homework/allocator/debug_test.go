@@ -0,0 +1,260 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v debug_test.go freelist_test.go handles_test.go
+
+const (
+	poisonByte     = 0xDE
+	canaryByte     = 0xCA
+	debugGuardSize = 16
+)
+
+var ErrCorrupted = errors.New("memory corrupted")
+
+// debug enables poisoning of freed and moved memory. Allocators created
+// while it is on also surround their blocks with guard bytes.
+var debug atomic.Bool
+
+// SetDebug switches debug mode and returns the previous setting, so it can
+// be restored with defer SetDebug(SetDebug(true)).
+func SetDebug(enabled bool) bool {
+	return debug.Swap(enabled)
+}
+
+// CorruptionError describes a block whose guard bytes were overwritten or a
+// free span that was written after it was released.
+type CorruptionError struct {
+	Block  Span
+	Offset int
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s at offset %#x in block [%#x, %#x)", e.Reason, e.Offset, e.Block.Offset, e.Block.End())
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorrupted
+}
+
+func poison(b []byte) {
+	fill(b, poisonByte)
+}
+
+func guard(b []byte) {
+	fill(b, canaryByte)
+}
+
+// scrub clears memory that is no longer used, or poisons it in debug mode.
+func scrub(b []byte, poisoned bool) {
+	if poisoned {
+		poison(b)
+	} else {
+		clear(b)
+	}
+}
+
+func fill(b []byte, value byte) {
+	for i := range b {
+		b[i] = value
+	}
+}
+
+// mismatch returns the index of the first byte of b different from value.
+func mismatch(b []byte, value byte) int {
+	for i, v := range b {
+		if v != value {
+			return i
+		}
+	}
+	return -1
+}
+
+// guardValue prepares size bytes at offset for a value of an allocator that
+// releases memory only by a reset. The memory is poisoned rather than
+// zeroed by the reset, so the value is cleared, and it is followed by
+// debugGuardSize guard bytes. The returned span covers both.
+func guardValue(memory []byte, offset, size int) Span {
+	clear(memory[offset : offset+size])
+	guard(memory[offset+size : offset+size+debugGuardSize])
+	return Span{Offset: offset, Size: size + debugGuardSize}
+}
+
+// verifyGuardedValue checks the guard bytes of a span returned by guardValue.
+func verifyGuardedValue(memory []byte, span Span) error {
+	end := span.End() - debugGuardSize
+	if i := mismatch(memory[end:span.End()], canaryByte); i != -1 {
+		return &CorruptionError{Block: span, Offset: end + i, Reason: "back guard overwritten"}
+	}
+	return nil
+}
+
+// Verify checks the guard bytes of every block and that free memory is
+// still poisoned. It reports the first corruption found in address order.
+// Without debug mode there is nothing to verify.
+func (a *Allocator) Verify() error {
+	if !a.debug {
+		return nil
+	}
+
+	spans := make([]Span, 0, len(a.allocated)+len(a.free))
+	blocks := map[int]int{}
+	for offset, block := range a.allocated {
+		span := block.span(offset)
+		blocks[span.Offset] = offset
+		spans = append(spans, span)
+	}
+	spans = append(spans, a.free...)
+	slices.SortFunc(spans, func(a, b Span) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+
+	for _, span := range spans {
+		offset, ok := blocks[span.Offset]
+		if !ok {
+			if i := mismatch(a.memory[span.Offset:span.End()], poisonByte); i != -1 {
+				return &CorruptionError{Block: span, Offset: span.Offset + i, Reason: "write after free"}
+			}
+			continue
+		}
+
+		if err := a.verifyBlock(offset, a.allocated[offset]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Allocator) verifyBlock(offset int, block allocation) error {
+	span := block.span(offset)
+	if i := mismatch(a.memory[span.Offset:offset], canaryByte); i != -1 {
+		return &CorruptionError{Block: span, Offset: span.Offset + i, Reason: "front guard overwritten"}
+	}
+
+	end := offset + block.size
+	if i := mismatch(a.memory[end:span.End()], canaryByte); i != -1 {
+		return &CorruptionError{Block: span, Offset: end + i, Reason: "back guard overwritten"}
+	}
+	return nil
+}
+
+func TestDebugPoisonOnFree(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	memory := alignedMemory(128)
+	a := NewAllocator(memory, FirstFit{})
+	assert.Equal(t, -1, mismatch(memory, poisonByte))
+
+	ptr, err := a.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[16]), ptr)
+	assert.Equal(t, -1, mismatch(memory[:16], canaryByte))
+	assert.Equal(t, -1, mismatch(memory[24:40], canaryByte))
+
+	block := unsafe.Slice((*byte)(ptr), 8)
+	copy(block, "contents")
+	assert.NoError(t, a.Verify())
+
+	assert.NoError(t, a.Free(ptr))
+	assert.Equal(t, -1, mismatch(memory, poisonByte))
+	assert.NoError(t, a.Verify())
+}
+
+func TestDebugGuards(t *testing.T) {
+	tests := map[string]struct {
+		offset int
+		reason string
+	}{
+		"front guard": {offset: -1, reason: "front guard overwritten"},
+		"back guard":  {offset: 8, reason: "back guard overwritten"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer SetDebug(SetDebug(true))
+
+			memory := alignedMemory(128)
+			a := NewAllocator(memory, FirstFit{})
+			_, err := a.Alloc(4, 1)
+			assert.NoError(t, err)
+			ptr, err := a.Alloc(8, 1)
+			assert.NoError(t, err)
+
+			start := int(uintptr(ptr) - uintptr(unsafe.Pointer(&memory[0])))
+			memory[start+test.offset] = 0
+
+			var corruption *CorruptionError
+			err = a.Verify()
+			assert.ErrorIs(t, err, ErrCorrupted)
+			assert.ErrorAs(t, err, &corruption)
+			assert.Equal(t, &CorruptionError{
+				Block:  Span{Offset: 36, Size: 40},
+				Offset: start + test.offset,
+				Reason: test.reason,
+			}, corruption)
+
+			// the corrupted block is not released
+			assert.Equal(t, err, a.Free(ptr))
+			assert.Equal(t, 2, a.Stats().Allocations)
+		})
+	}
+}
+
+func TestDebugWriteAfterFree(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	memory := alignedMemory(128)
+	a := NewAllocator(memory, FirstFit{})
+	ptr, err := a.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.NoError(t, a.Free(ptr))
+
+	*(*byte)(ptr) = 1
+	assert.Equal(t, &CorruptionError{
+		Block:  Span{Offset: 0, Size: 128},
+		Offset: 16,
+		Reason: "write after free",
+	}, a.Verify())
+}
+
+func TestDebugDefragment(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	memory := alignedMemory(128)
+	a := NewAllocator(memory, FirstFit{})
+	first, err := a.Alloc(8, 8)
+	assert.NoError(t, err)
+	second, err := a.Alloc(8, 8)
+	assert.NoError(t, err)
+	copy(unsafe.Slice((*byte)(second), 8), "moved!!!")
+
+	assert.NoError(t, a.Free(first))
+	moved := a.Defragment()
+
+	ptr := moved[second]
+	assert.Equal(t, unsafe.Pointer(&memory[16]), ptr)
+	assert.Equal(t, "moved!!!", string(unsafe.Slice((*byte)(ptr), 8)))
+	assert.Equal(t, -1, mismatch(memory[40:], poisonByte))
+	assert.NoError(t, a.Verify())
+}
+
+func TestDebugDefragmentObjects(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	memory := alignedMemory(8)
+	copy(memory, []byte{0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04})
+	DefragmentObjects(memory, []Object{{Pointer: unsafe.Pointer(&memory[4]), Size: 4, Align: 1}})
+
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04, poisonByte, poisonByte, poisonByte, poisonByte}, memory)
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v freelist_test.go debug_test.go handles_test.go
+
+var (
+	ErrOutOfMemory    = errors.New("out of memory")
+	ErrInvalidPointer = errors.New("invalid pointer")
+	ErrInvalidSize    = errors.New("invalid size")
+)
+
+// Span is a range of bytes inside an allocator region.
+type Span struct {
+	Offset int
+	Size   int
+}
+
+func (s Span) End() int {
+	return s.Offset + s.Size
+}
+
+// PlacementStrategy chooses the free span a request is carved from.
+type PlacementStrategy interface {
+	// Find returns the index of a span in free for which fits is true or -1.
+	// Spans are sorted by offset.
+	Find(free []Span, fits func(Span) bool) int
+}
+
+type FirstFit struct{}
+
+func (FirstFit) Find(free []Span, fits func(Span) bool) int {
+	for i, span := range free {
+		if fits(span) {
+			return i
+		}
+	}
+	return -1
+}
+
+type BestFit struct{}
+
+func (BestFit) Find(free []Span, fits func(Span) bool) int {
+	best := -1
+	for i, span := range free {
+		if fits(span) && (best == -1 || span.Size < free[best].Size) {
+			best = i
+		}
+	}
+	return best
+}
+
+// NextFit continues searching from the span the previous allocation was
+// taken from and wraps around at the end of the region.
+type NextFit struct {
+	cursor int
+}
+
+func (n *NextFit) Find(free []Span, fits func(Span) bool) int {
+	start, _ := slices.BinarySearchFunc(free, n.cursor, func(span Span, offset int) int {
+		return span.End() - offset - 1
+	})
+
+	for i := range free {
+		j := (start + i) % len(free)
+		if fits(free[j]) {
+			n.cursor = free[j].Offset
+			return j
+		}
+	}
+	return -1
+}
+
+type allocation struct {
+	size  int
+	align int
+	front int // guard bytes before the block in debug mode
+	back  int // guard bytes after the block in debug mode
+}
+
+func (b allocation) span(offset int) Span {
+	return Span{Offset: offset - b.front, Size: b.front + b.size + b.back}
+}
+
+// Allocator manages a byte region with an address ordered free list.
+// Adjacent free spans are coalesced on Free.
+type Allocator struct {
+	memory    []byte
+	free      []Span
+	allocated map[int]allocation
+	strategy  PlacementStrategy
+	debug     bool
+	forward   map[int]int  // new offsets of blocks moved by an incremental pass
+	backward  map[int]int  // old offsets of the blocks in forward
+	freed     map[int]bool // offsets freed during an incremental pass
+}
+
+// NewAllocator manages memory with the given strategy. When debug mode is on
+// (see SetDebug) the region is poisoned and every block is surrounded by
+// guard bytes.
+func NewAllocator(memory []byte, strategy PlacementStrategy) *Allocator {
+	a := &Allocator{
+		memory:    memory,
+		allocated: map[int]allocation{},
+		strategy:  strategy,
+		debug:     debug.Load(),
+	}
+	if len(memory) > 0 {
+		a.free = []Span{{Offset: 0, Size: len(memory)}}
+	}
+	if a.debug {
+		poison(memory)
+	}
+	return a
+}
+
+func (a *Allocator) Alloc(size, align int) (unsafe.Pointer, error) {
+	if size <= 0 || align <= 0 || align&(align-1) != 0 {
+		return nil, ErrInvalidSize
+	}
+
+	if size > len(a.memory) || align > len(a.memory) {
+		// also keeps the fit check below from overflowing
+		return nil, ErrOutOfMemory
+	}
+
+	block := allocation{size: size, align: align}
+	if a.debug {
+		// the front guard is a multiple of align, so the guarded span has the
+		// same alignment as the block itself
+		block.front, block.back = max(debugGuardSize, align), debugGuardSize
+	}
+
+	i := a.strategy.Find(a.free, func(span Span) bool {
+		return a.alignOffset(span.Offset+block.front, align)+size+block.back <= span.End()
+	})
+	if i == -1 {
+		return nil, ErrOutOfMemory
+	}
+
+	offset := a.alignOffset(a.free[i].Offset+block.front, align)
+	used := block.span(offset)
+	a.take(i, used)
+
+	if a.debug {
+		guard(a.memory[used.Offset:offset])
+		guard(a.memory[offset+size : used.End()])
+	}
+
+	a.allocated[offset] = block
+	return unsafe.Pointer(&a.memory[offset]), nil
+}
+
+// Free releases the block at ptr, which may also be an address the block had
+// before an incremental defragmentation moved it. In debug mode the guard
+// bytes are verified first and a *CorruptionError is returned without
+// releasing the block if they were overwritten.
+func (a *Allocator) Free(ptr unsafe.Pointer) error {
+	offset, ok := a.offset(ptr)
+	if !ok {
+		return ErrInvalidPointer
+	}
+	offset = a.resolve(offset)
+
+	block, ok := a.allocated[offset]
+	if !ok {
+		return ErrInvalidPointer
+	}
+
+	used := block.span(offset)
+	if a.debug {
+		if err := a.verifyBlock(offset, block); err != nil {
+			return err
+		}
+		poison(a.memory[used.Offset:used.End()])
+	}
+
+	// the memory may be reused, so the old address must stop resolving to it
+	if from, ok := a.backward[offset]; ok {
+		delete(a.forward, from)
+		delete(a.backward, offset)
+	}
+	if a.freed != nil {
+		a.freed[offset] = true
+	}
+	delete(a.allocated, offset)
+	a.release(used)
+	return nil
+}
+
+// Size returns the requested size of the allocation at ptr.
+func (a *Allocator) Size(ptr unsafe.Pointer) int {
+	offset, ok := a.offset(ptr)
+	if !ok {
+		return 0
+	}
+	return a.allocated[a.resolve(offset)].size
+}
+
+// Defragment moves every allocation to the start of the region and returns
+// the new address of each moved pointer. It panics during an incremental
+// pass.
+func (a *Allocator) Defragment() map[unsafe.Pointer]unsafe.Pointer {
+	if a.forward != nil {
+		panic("incremental defragmentation in progress")
+	}
+
+	offsets := make([]int, 0, len(a.allocated))
+	for offset := range a.allocated {
+		offsets = append(offsets, offset)
+	}
+	slices.Sort(offsets)
+
+	objects := make([]Object, len(offsets))
+	for i, offset := range offsets {
+		block := a.allocated[offset]
+		used := block.span(offset)
+		objects[i] = Object{Pointer: unsafe.Pointer(&a.memory[used.Offset]), Size: used.Size, Align: block.align}
+	}
+
+	defragmentObjects(a.memory, objects, a.debug)
+
+	moved := map[unsafe.Pointer]unsafe.Pointer{}
+	allocated := make(map[int]allocation, len(a.allocated))
+	a.free = a.free[:0]
+	end := 0
+	for i, object := range objects {
+		block := a.allocated[offsets[i]]
+		start, _ := a.offset(object.Pointer)
+		offset := start + block.front
+
+		allocated[offset] = block
+		if offset != offsets[i] {
+			moved[unsafe.Pointer(&a.memory[offsets[i]])] = unsafe.Pointer(&a.memory[offset])
+		}
+
+		// padding required by alignment stays free
+		if start > end {
+			a.free = append(a.free, Span{Offset: end, Size: start - end})
+		}
+		end = start + object.Size
+	}
+	a.allocated = allocated
+
+	if end < len(a.memory) {
+		a.free = append(a.free, Span{Offset: end, Size: len(a.memory) - end})
+	}
+
+	return moved
+}
+
+type Stats struct {
+	Size        int
+	Used        int
+	Free        int
+	Allocations int
+	FreeSpans   int
+	LargestFree int
+}
+
+// Fragmentation is the share of free memory that cannot be used for an
+// allocation as large as the total free memory: 0 when all free memory is
+// contiguous, close to 1 when it is scattered in small spans.
+func (s Stats) Fragmentation() float64 {
+	if s.Free == 0 {
+		return 0
+	}
+	return 1 - float64(s.LargestFree)/float64(s.Free)
+}
+
+// ShouldDefragment reports whether compaction would let an allocation of size
+// bytes succeed that fails now.
+func (s Stats) ShouldDefragment(size int) bool {
+	return s.LargestFree < size && s.Free >= size
+}
+
+func (a *Allocator) Stats() Stats {
+	stats := Stats{
+		Size:        len(a.memory),
+		Allocations: len(a.allocated),
+		FreeSpans:   len(a.free),
+	}
+
+	for _, span := range a.free {
+		stats.Free += span.Size
+		stats.LargestFree = max(stats.LargestFree, span.Size)
+	}
+	stats.Used = stats.Size - stats.Free
+
+	return stats
+}
+
+// take removes used from the free span i that contains it.
+func (a *Allocator) take(i int, used Span) {
+	span := a.free[i]
+
+	var rest []Span
+	if used.Offset > span.Offset {
+		rest = append(rest, Span{Offset: span.Offset, Size: used.Offset - span.Offset})
+	}
+	if used.End() < span.End() {
+		rest = append(rest, Span{Offset: used.End(), Size: span.End() - used.End()})
+	}
+	a.free = slices.Replace(a.free, i, i+1, rest...)
+}
+
+func (a *Allocator) release(span Span) {
+	i, _ := slices.BinarySearchFunc(a.free, span.Offset, func(free Span, offset int) int {
+		return free.Offset - offset
+	})
+
+	if i < len(a.free) && span.End() == a.free[i].Offset {
+		span.Size += a.free[i].Size
+		a.free = slices.Delete(a.free, i, i+1)
+	}
+	if i > 0 && a.free[i-1].End() == span.Offset {
+		a.free[i-1].Size += span.Size
+		return
+	}
+	a.free = slices.Insert(a.free, i, span)
+}
+
+func (a *Allocator) offset(ptr unsafe.Pointer) (int, bool) {
+	if len(a.memory) == 0 || ptr == nil {
+		return 0, false
+	}
+
+	offset := uintptr(ptr) - uintptr(unsafe.Pointer(&a.memory[0]))
+	if offset >= uintptr(len(a.memory)) {
+		return 0, false
+	}
+	return int(offset), true
+}
+
+// resolve follows the forwarding table of an incremental defragmentation.
+func (a *Allocator) resolve(offset int) int {
+	if to, ok := a.forward[offset]; ok {
+		return to
+	}
+	return offset
+}
+
+func (a *Allocator) alignOffset(offset, align int) int {
+	return alignOffset(uintptr(unsafe.Pointer(&a.memory[0])), offset, align)
+}
+
+func TestPlacementStrategies(t *testing.T) {
+	free := []Span{
+		{Offset: 0, Size: 16},
+		{Offset: 32, Size: 8},
+		{Offset: 48, Size: 32},
+		{Offset: 96, Size: 12},
+	}
+	fits := func(size int) func(Span) bool {
+		return func(span Span) bool { return span.Size >= size }
+	}
+
+	tests := map[string]struct {
+		strategy PlacementStrategy
+		sizes    []int
+		indexes  []int
+	}{
+		"first fit": {
+			strategy: FirstFit{},
+			sizes:    []int{20, 10, 14, 40},
+			indexes:  []int{2, 0, 0, -1},
+		},
+		"best fit": {
+			strategy: BestFit{},
+			sizes:    []int{20, 10, 14, 40},
+			indexes:  []int{2, 3, 0, -1},
+		},
+		"next fit": {
+			strategy: &NextFit{},
+			sizes:    []int{20, 10, 14, 40},
+			indexes:  []int{2, 2, 2, -1},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			for i, size := range test.sizes {
+				assert.Equal(t, test.indexes[i], test.strategy.Find(free, fits(size)))
+			}
+		})
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	memory := alignedMemory(64)
+	a := NewAllocator(memory, FirstFit{})
+
+	p1, err := a.Alloc(10, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[0]), p1)
+
+	p2, err := a.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[16]), p2)
+
+	p3, err := a.Alloc(4, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[12]), p3)
+
+	assert.Equal(t, Stats{
+		Size: 64, Used: 22, Free: 42, Allocations: 3, FreeSpans: 2, LargestFree: 40,
+	}, a.Stats())
+
+	_, err = a.Alloc(64, 1)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = a.Alloc(math.MaxInt-8, 8)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = a.Alloc(8, 1<<62)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = a.Alloc(0, 1)
+	assert.ErrorIs(t, err, ErrInvalidSize)
+	_, err = a.Alloc(1, 3)
+	assert.ErrorIs(t, err, ErrInvalidSize)
+
+	// freeing the middle block and its neighbours coalesces everything
+	assert.NoError(t, a.Free(p3))
+	assert.Equal(t, []Span{{Offset: 10, Size: 6}, {Offset: 24, Size: 40}}, a.free)
+	assert.NoError(t, a.Free(p1))
+	assert.Equal(t, []Span{{Offset: 0, Size: 16}, {Offset: 24, Size: 40}}, a.free)
+	assert.NoError(t, a.Free(p2))
+	assert.Equal(t, []Span{{Offset: 0, Size: 64}}, a.free)
+
+	assert.ErrorIs(t, a.Free(p2), ErrInvalidPointer)
+	assert.ErrorIs(t, a.Free(unsafe.Pointer(&memory[1])), ErrInvalidPointer)
+	assert.ErrorIs(t, a.Free(unsafe.Pointer(&[]byte{0}[0])), ErrInvalidPointer)
+}
+
+func TestAllocatorDefragment(t *testing.T) {
+	memory := alignedMemory(64)
+	a := NewAllocator(memory, BestFit{})
+
+	var pointers []unsafe.Pointer
+	for i := range 8 {
+		ptr, err := a.Alloc(8, 8)
+		assert.NoError(t, err)
+		*(*byte)(ptr) = byte(i)
+		pointers = append(pointers, ptr)
+	}
+
+	for i := 0; i < len(pointers); i += 2 {
+		assert.NoError(t, a.Free(pointers[i]))
+	}
+
+	stats := a.Stats()
+	assert.Equal(t, 32, stats.Free)
+	assert.Equal(t, 8, stats.LargestFree)
+	assert.InDelta(t, 0.75, stats.Fragmentation(), 1e-9)
+	assert.True(t, stats.ShouldDefragment(16))
+	assert.False(t, stats.ShouldDefragment(8))
+	assert.False(t, stats.ShouldDefragment(40))
+
+	_, err := a.Alloc(16, 8)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+
+	moved := a.Defragment()
+	assert.Len(t, moved, 4)
+	for i := 1; i < len(pointers); i += 2 {
+		ptr, ok := moved[pointers[i]]
+		assert.True(t, ok)
+		assert.Equal(t, byte(i), *(*byte)(ptr))
+		assert.Equal(t, 8, a.Size(ptr))
+	}
+
+	stats = a.Stats()
+	assert.Zero(t, stats.Fragmentation())
+	assert.Equal(t, 1, stats.FreeSpans)
+
+	ptr, err := a.Alloc(16, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[32]), ptr)
+}
+
+func BenchmarkPlacementStrategies(b *testing.B) {
+	strategies := map[string]func() PlacementStrategy{
+		"first fit": func() PlacementStrategy { return FirstFit{} },
+		"best fit":  func() PlacementStrategy { return BestFit{} },
+		"next fit":  func() PlacementStrategy { return &NextFit{} },
+	}
+
+	for name, strategy := range strategies {
+		b.Run(name, func(b *testing.B) {
+			memory := make([]byte, 1<<18)
+			random := rand.New(rand.NewSource(1))
+			failed := 0
+
+			for i := 0; i < b.N; i++ {
+				a := NewAllocator(memory, strategy())
+				var live []unsafe.Pointer
+
+				for range 1000 {
+					if len(live) > 0 && random.Intn(3) == 0 {
+						j := random.Intn(len(live))
+						_ = a.Free(live[j])
+						live = slices.Delete(live, j, j+1)
+						continue
+					}
+
+					ptr, err := a.Alloc(16+random.Intn(4096), 8)
+					if err != nil {
+						failed++
+						continue
+					}
+					live = append(live, ptr)
+				}
+			}
+
+			b.ReportMetric(float64(failed)/float64(b.N), "failed/op")
+		})
+	}
+}
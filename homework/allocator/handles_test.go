@@ -0,0 +1,307 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v handles_test.go debug_test.go freelist_test.go
+
+// Object is a block of Size bytes inside the defragmented memory whose
+// address must be a multiple of Align.
+type Object struct {
+	Pointer unsafe.Pointer
+	Size    int
+	Align   int
+}
+
+// DefragmentObjects slides objects towards the start of memory in address
+// order, respecting their alignment, and updates their pointers. Bytes left
+// behind by a move are zeroed, or poisoned in debug mode. It panics without
+// moving anything if an object is outside memory, overlaps another one or is
+// not aligned.
+func DefragmentObjects(memory []byte, objects []Object) {
+	defragmentObjects(memory, objects, debug.Load())
+}
+
+func defragmentObjects(memory []byte, objects []Object, poisoned bool) {
+	if len(memory) == 0 {
+		return
+	}
+
+	base := uintptr(unsafe.Pointer(&memory[0]))
+	order := make([]int, len(objects))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(uintptr(objects[a].Pointer), uintptr(objects[b].Pointer))
+	})
+
+	// everything is checked before the first move, so a panic leaves memory
+	// untouched
+	end := 0
+	for _, i := range order {
+		object := objects[i]
+		src := int(uintptr(object.Pointer) - base)
+		if src < end || src+object.Size > len(memory) {
+			panic("object is out of memory bounds or overlaps another object")
+		}
+		if alignOffset(base, src, object.Align) != src {
+			panic("object is not aligned")
+		}
+		end = src + object.Size
+	}
+
+	offset := 0
+	for _, i := range order {
+		object := &objects[i]
+		src := int(uintptr(object.Pointer) - base)
+
+		// an aligned object never has to move forward to stay aligned
+		dst := alignOffset(base, offset, object.Align)
+
+		copy(memory[dst:dst+object.Size], memory[src:src+object.Size])
+		scrub(memory[max(src, dst+object.Size):src+object.Size], poisoned)
+
+		object.Pointer = unsafe.Pointer(&memory[dst])
+		offset = dst + object.Size
+	}
+}
+
+// alignOffset returns the smallest offset >= offset whose address is a
+// multiple of align.
+func alignOffset(base uintptr, offset, align int) int {
+	if align <= 1 {
+		return offset
+	}
+
+	address := base + uintptr(offset)
+	padding := (uintptr(align) - address%uintptr(align)) % uintptr(align)
+	return offset + int(padding)
+}
+
+// Handle is a stable reference to an object registered in a HandleTable.
+// The zero Handle is never returned by Register.
+type Handle int
+
+// HandleTable lets callers keep handles instead of raw pointers, so objects
+// can be relocated by Defragment without invalidating references to them.
+type HandleTable struct {
+	memory  []byte
+	objects []Object
+	free    []Handle
+}
+
+func NewHandleTable(memory []byte) *HandleTable {
+	return &HandleTable{memory: memory}
+}
+
+// Register returns a handle for the object at ptr, it panics if ptr is nil.
+func (t *HandleTable) Register(ptr unsafe.Pointer, size, align int) Handle {
+	if ptr == nil {
+		panic("nil pointer")
+	}
+	object := Object{Pointer: ptr, Size: size, Align: align}
+
+	if len(t.free) > 0 {
+		handle := t.free[len(t.free)-1]
+		t.free = t.free[:len(t.free)-1]
+		t.objects[handle-1] = object
+		return handle
+	}
+
+	t.objects = append(t.objects, object)
+	return Handle(len(t.objects))
+}
+
+func (t *HandleTable) Release(handle Handle) {
+	if t.lookup(handle) == nil {
+		panic("invalid handle")
+	}
+
+	t.objects[handle-1] = Object{}
+	t.free = append(t.free, handle)
+}
+
+// Pointer returns the current address of the object, it is only valid until
+// the next Defragment.
+func (t *HandleTable) Pointer(handle Handle) unsafe.Pointer {
+	if object := t.lookup(handle); object != nil {
+		return object.Pointer
+	}
+	return nil
+}
+
+func (t *HandleTable) Bytes(handle Handle) []byte {
+	object := t.lookup(handle)
+	if object == nil {
+		return nil
+	}
+	return unsafe.Slice((*byte)(object.Pointer), object.Size)
+}
+
+func (t *HandleTable) Defragment() {
+	handles := make([]Handle, 0, len(t.objects))
+	objects := make([]Object, 0, len(t.objects))
+	for i, object := range t.objects {
+		if object.Pointer != nil {
+			handles = append(handles, Handle(i+1))
+			objects = append(objects, object)
+		}
+	}
+
+	DefragmentObjects(t.memory, objects)
+
+	for i, handle := range handles {
+		t.objects[handle-1] = objects[i]
+	}
+}
+
+func (t *HandleTable) lookup(handle Handle) *Object {
+	if handle <= 0 || int(handle) > len(t.objects) || t.objects[handle-1].Pointer == nil {
+		return nil
+	}
+	return &t.objects[handle-1]
+}
+
+func TestDefragmentObjects(t *testing.T) {
+	tests := map[string]struct {
+		memory   []byte
+		objects  []Object
+		offsets  []int
+		expected []byte
+	}{
+		"overlapping move": {
+			memory: []byte{
+				0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x00, 0x00,
+			},
+			objects:  []Object{{Size: 4, Align: 1}},
+			offsets:  []int{2},
+			expected: []byte{0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00, 0x00},
+		},
+		"objects are packed in address order": {
+			memory: []byte{
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0A, 0x0B,
+				0x00, 0x01, 0x02, 0x03, 0x00, 0x00, 0x00, 0x00,
+			},
+			objects: []Object{{Size: 3, Align: 1}, {Size: 2, Align: 1}},
+			offsets: []int{9, 6},
+			expected: []byte{
+				0x0A, 0x0B, 0x01, 0x02, 0x03, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+		},
+		"alignment": {
+			memory: []byte{
+				0x00, 0x00, 0x00, 0xAA, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+			},
+			objects: []Object{{Size: 1, Align: 1}, {Size: 4, Align: 4}},
+			offsets: []int{3, 12},
+			expected: []byte{
+				0xAA, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+		},
+		"already compact": {
+			memory: []byte{
+				0x01, 0x02, 0x00, 0x00, 0x03, 0x04, 0x05, 0x06,
+			},
+			objects:  []Object{{Size: 2, Align: 2}, {Size: 4, Align: 4}},
+			offsets:  []int{0, 4},
+			expected: []byte{0x01, 0x02, 0x00, 0x00, 0x03, 0x04, 0x05, 0x06},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			memory := alignedMemory(len(test.memory))
+			copy(memory, test.memory)
+
+			for i := range test.objects {
+				test.objects[i].Pointer = unsafe.Pointer(&memory[test.offsets[i]])
+			}
+
+			DefragmentObjects(memory, test.objects)
+			assert.Equal(t, test.expected, memory)
+
+			for _, object := range test.objects {
+				offset := int(uintptr(object.Pointer) - uintptr(unsafe.Pointer(&memory[0])))
+				assert.Zero(t, offset%object.Align)
+			}
+		})
+	}
+}
+
+func TestDefragmentObjectsOverlapping(t *testing.T) {
+	memory := alignedMemory(8)
+	objects := []Object{
+		{Pointer: unsafe.Pointer(&memory[0]), Size: 4, Align: 1},
+		{Pointer: unsafe.Pointer(&memory[2]), Size: 4, Align: 1},
+	}
+
+	assert.Panics(t, func() {
+		DefragmentObjects(memory, objects)
+	})
+}
+
+func TestDefragmentObjectsMisaligned(t *testing.T) {
+	memory := alignedMemory(16)
+	copy(memory, []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07})
+	objects := []Object{
+		{Pointer: unsafe.Pointer(&memory[1]), Size: 1, Align: 1},
+		{Pointer: unsafe.Pointer(&memory[3]), Size: 4, Align: 4},
+	}
+
+	assert.PanicsWithValue(t, "object is not aligned", func() {
+		DefragmentObjects(memory, objects)
+	})
+	assert.Equal(t, []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}, memory[:8])
+	assert.Equal(t, unsafe.Pointer(&memory[1]), objects[0].Pointer)
+}
+
+func TestHandleTable(t *testing.T) {
+	memory := alignedMemory(32)
+	copy(memory[5:], "hello")
+	copy(memory[16:], []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})
+	copy(memory[27:], "bye")
+
+	table := NewHandleTable(memory)
+	hello := table.Register(unsafe.Pointer(&memory[5]), 5, 1)
+	number := table.Register(unsafe.Pointer(&memory[16]), 8, 8)
+	bye := table.Register(unsafe.Pointer(&memory[27]), 3, 1)
+
+	table.Release(hello)
+	table.Defragment()
+
+	assert.Equal(t, unsafe.Pointer(&memory[0]), table.Pointer(number))
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, table.Bytes(number))
+	assert.Equal(t, unsafe.Pointer(&memory[8]), table.Pointer(bye))
+	assert.Equal(t, "bye", string(table.Bytes(bye)))
+	assert.Equal(t, make([]byte, 21), memory[11:])
+
+	assert.Nil(t, table.Pointer(hello))
+	assert.Nil(t, table.Bytes(hello))
+	assert.Panics(t, func() { table.Release(hello) })
+	assert.Panics(t, func() { table.Register(nil, 1, 1) })
+
+	// released handles are reused
+	copy(memory[16:], "again")
+	again := table.Register(unsafe.Pointer(&memory[16]), 5, 1)
+	assert.Equal(t, hello, again)
+
+	table.Defragment()
+	assert.Equal(t, unsafe.Pointer(&memory[11]), table.Pointer(again))
+	assert.Equal(t, "again", string(table.Bytes(again)))
+}
+
+// alignedMemory returns a slice whose first byte is 8-byte aligned.
+func alignedMemory(size int) []byte {
+	words := make([]uint64, (size+7)/8)
+	return unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), size)
+}
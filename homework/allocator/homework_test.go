@@ -8,22 +8,27 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-// go test -v homework_test.go
+// go test -v homework_test.go handles_test.go debug_test.go freelist_test.go
 
+// Defragment moves one byte objects to the start of memory, see
+// DefragmentObjects for objects of other sizes. The objects keep their
+// relative order in memory, whatever the order of pointers, and pointers[i]
+// is updated to the new address of the object it referred to. It panics if
+// a pointer is outside memory or two pointers refer to the same byte.
 func Defragment(memory []byte, pointers []unsafe.Pointer) {
 	if len(pointers) > len(memory) {
 		panic("len(pointers) > len(memory)")
 	}
 
-	for i, unsafePtr := range pointers {
-		value := *(*byte)(unsafePtr)
-		pointer := (*byte)(unsafePtr)
-		*pointer = 0
-
-		memory[i] = value
-		pointers[i] = unsafe.Pointer(&memory[i])
+	objects := make([]Object, len(pointers))
+	for i, pointer := range pointers {
+		objects[i] = Object{Pointer: pointer, Size: 1, Align: 1}
 	}
+	DefragmentObjects(memory, objects)
 
+	for i := range objects {
+		pointers[i] = objects[i].Pointer
+	}
 }
 
 func TestDefragmentation(t *testing.T) {
@@ -59,3 +64,39 @@ func TestDefragmentation(t *testing.T) {
 	assert.True(t, reflect.DeepEqual(defragmentedMemory, fragmentedMemory))
 	assert.True(t, reflect.DeepEqual(defragmentedPointers, fragmentedPointers))
 }
+
+func TestDefragmentationDebug(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	memory := []byte{0x00, 0x11, 0x00, 0x22}
+	pointers := []unsafe.Pointer{unsafe.Pointer(&memory[1]), unsafe.Pointer(&memory[3])}
+	Defragment(memory, pointers)
+
+	// the byte left behind by the last move is poisoned instead of zeroed
+	assert.Equal(t, []byte{0x11, 0x22, 0x00, poisonByte}, memory)
+	assert.Equal(t, []unsafe.Pointer{unsafe.Pointer(&memory[0]), unsafe.Pointer(&memory[1])}, pointers)
+}
+
+func TestDefragmentationUnsorted(t *testing.T) {
+	memory := []byte{0x00, 0x11, 0x00, 0x22, 0x33}
+	pointers := []unsafe.Pointer{
+		unsafe.Pointer(&memory[4]),
+		unsafe.Pointer(&memory[1]),
+		unsafe.Pointer(&memory[3]),
+	}
+	Defragment(memory, pointers)
+
+	// objects are packed in address order, not in the order of pointers
+	assert.Equal(t, []byte{0x11, 0x22, 0x33, 0x00, 0x00}, memory)
+	assert.Equal(t, []unsafe.Pointer{
+		unsafe.Pointer(&memory[2]),
+		unsafe.Pointer(&memory[0]),
+		unsafe.Pointer(&memory[1]),
+	}, pointers)
+
+	outside := []byte{0x44}
+	assert.Panics(t, func() { Defragment(memory, []unsafe.Pointer{unsafe.Pointer(&outside[0])}) })
+	assert.Panics(t, func() {
+		Defragment(memory, []unsafe.Pointer{unsafe.Pointer(&memory[1]), unsafe.Pointer(&memory[1])})
+	})
+}
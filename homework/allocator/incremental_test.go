@@ -0,0 +1,322 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v incremental_test.go freelist_test.go debug_test.go handles_test.go
+
+// Defragmenter compacts an Allocator in steps that each copy about target
+// bytes, so the pauses stay short. The target is a soft bound: a block is
+// never split across steps, so one larger than the target is moved in a step
+// of its own. It is a two-finger compaction: the blocks allocated when the
+// pass starts are visited from the end of the region and each one is moved
+// to the lowest free span below it that fits. Blocks allocated during the
+// pass stay where they are.
+//
+// Memory vacated by a move is kept out of the free list until Finish, so an
+// old address never refers to another block during the pass and Free, Size
+// and Resolve of the allocator accept both old and new addresses. The
+// allocator can be used normally between steps.
+type Defragmenter struct {
+	allocator *Allocator
+	target    int
+	work      []int // offsets of the blocks to visit, highest first
+	next      int   // index of the next block in work
+	vacated   []Span
+	done      bool
+}
+
+// StartDefragment begins an incremental pass in which each Step visits
+// blocks until their sizes, without guard bytes, add up to target.
+func (a *Allocator) StartDefragment(target int) *Defragmenter {
+	if target <= 0 {
+		panic("defragmentation target must be positive")
+	}
+	if a.forward != nil {
+		panic("incremental defragmentation in progress")
+	}
+
+	work := make([]int, 0, len(a.allocated))
+	for offset := range a.allocated {
+		work = append(work, offset)
+	}
+	slices.Sort(work)
+	slices.Reverse(work)
+
+	a.forward, a.backward, a.freed = map[int]int{}, map[int]int{}, map[int]bool{}
+	return &Defragmenter{allocator: a, target: target, work: work}
+}
+
+// Step visits blocks until the target is reached and reports whether the
+// pass has visited every block. Blocks count against the target whether or
+// not they can be moved.
+func (d *Defragmenter) Step() bool {
+	if d.done {
+		return true
+	}
+
+	a := d.allocator
+	visited := 0
+	for ; d.next < len(d.work); d.next++ {
+		offset := d.work[d.next]
+		if a.freed[offset] {
+			// any block there now was allocated or moved during the pass
+			continue
+		}
+
+		size := a.allocated[offset].size
+		if visited > 0 && visited+size > d.target {
+			return false
+		}
+		visited += size
+		d.move(offset)
+	}
+
+	d.done = true
+	return true
+}
+
+// Finish ends the pass, whether or not it is done, and returns the new
+// address of each moved pointer. Vacated memory becomes free and old
+// addresses are no longer resolved afterwards.
+func (d *Defragmenter) Finish() map[unsafe.Pointer]unsafe.Pointer {
+	a := d.allocator
+	if a.forward == nil {
+		panic("defragmentation already finished")
+	}
+
+	moved := make(map[unsafe.Pointer]unsafe.Pointer, len(a.forward))
+	for from, to := range a.forward {
+		moved[unsafe.Pointer(&a.memory[from])] = unsafe.Pointer(&a.memory[to])
+	}
+
+	for _, span := range d.vacated {
+		a.release(span)
+	}
+	d.vacated = nil
+	d.done = true
+	a.forward, a.backward, a.freed = nil, nil, nil
+
+	return moved
+}
+
+// move copies the block at offset to the lowest free span below it that
+// fits, if there is one.
+func (d *Defragmenter) move(offset int) {
+	a := d.allocator
+	block := a.allocated[offset]
+	used := block.span(offset)
+
+	// only the spans below the block are searched
+	below, _ := slices.BinarySearchFunc(a.free, used.Offset, func(span Span, offset int) int {
+		return span.Offset - offset
+	})
+	i := FirstFit{}.Find(a.free[:below], func(span Span) bool {
+		return a.alignOffset(span.Offset+block.front, block.align)+block.size+block.back <= span.End()
+	})
+	if i == -1 {
+		return
+	}
+
+	to := a.alignOffset(a.free[i].Offset+block.front, block.align)
+	target := block.span(to)
+	a.take(i, target)
+
+	copy(a.memory[target.Offset:target.End()], a.memory[used.Offset:used.End()])
+	scrub(a.memory[used.Offset:used.End()], a.debug)
+	d.vacated = append(d.vacated, used)
+
+	delete(a.allocated, offset)
+	a.allocated[to] = block
+	a.forward[offset] = to
+	a.backward[to] = offset
+}
+
+// Resolve returns the current address of the block at ptr, following the
+// forwarding table of an incremental pass.
+func (a *Allocator) Resolve(ptr unsafe.Pointer) unsafe.Pointer {
+	offset, ok := a.offset(ptr)
+	if !ok {
+		return ptr
+	}
+	return unsafe.Pointer(&a.memory[a.resolve(offset)])
+}
+
+func TestDefragmenter(t *testing.T) {
+	memory := alignedMemory(128)
+	a := NewAllocator(memory, FirstFit{})
+
+	var pointers []unsafe.Pointer
+	for i, size := range []int{16, 16, 32, 16, 8} {
+		ptr, err := a.Alloc(size, 8)
+		assert.NoError(t, err)
+		fill(unsafe.Slice((*byte)(ptr), size), byte(i+1))
+		pointers = append(pointers, ptr)
+	}
+	assert.NoError(t, a.Free(pointers[0]))
+	assert.NoError(t, a.Free(pointers[2]))
+
+	d := a.StartDefragment(16)
+
+	// the last block fills the first hole, the next one exceeds the target
+	assert.False(t, d.Step())
+	assert.Equal(t, unsafe.Pointer(&memory[0]), a.Resolve(pointers[4]))
+	assert.Equal(t, 8, a.Size(pointers[4]))
+	assert.Equal(t, []byte{5, 5, 5, 5, 5, 5, 5, 5}, memory[:8])
+	assert.Equal(t, []Span{{Offset: 8, Size: 8}, {Offset: 32, Size: 32}, {Offset: 88, Size: 40}}, a.free)
+
+	// vacated memory is not handed out during the pass
+	ptr, err := a.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[8]), ptr)
+	assert.NoError(t, a.Free(ptr))
+
+	assert.False(t, d.Step())
+	assert.Equal(t, unsafe.Pointer(&memory[32]), a.Resolve(pointers[3]))
+	assert.Equal(t, make([]byte, 24), memory[64:88])
+
+	// no hole below the second block fits it
+	assert.True(t, d.Step())
+	assert.True(t, d.Step())
+	assert.Equal(t, pointers[1], a.Resolve(pointers[1]))
+
+	moved := d.Finish()
+	assert.Equal(t, map[unsafe.Pointer]unsafe.Pointer{
+		pointers[3]: unsafe.Pointer(&memory[32]),
+		pointers[4]: unsafe.Pointer(&memory[0]),
+	}, moved)
+	assert.Equal(t, []Span{{Offset: 8, Size: 8}, {Offset: 48, Size: 80}}, a.free)
+	assert.Equal(t, pointers[4], a.Resolve(pointers[4]))
+	assert.Panics(t, func() { d.Finish() })
+}
+
+func TestDefragmenterInterrupted(t *testing.T) {
+	memory := alignedMemory(256)
+	a := NewAllocator(memory, FirstFit{})
+
+	first, err := a.Alloc(64, 8)
+	assert.NoError(t, err)
+	large, err := a.Alloc(64, 8)
+	assert.NoError(t, err)
+	small, err := a.Alloc(32, 8)
+	assert.NoError(t, err)
+	last, err := a.Alloc(32, 8)
+	assert.NoError(t, err)
+	assert.NoError(t, a.Free(first))
+
+	d := a.StartDefragment(32)
+	assert.Panics(t, func() { a.StartDefragment(32) })
+	assert.Panics(t, func() { a.Defragment() })
+
+	assert.False(t, d.Step())
+	assert.Equal(t, unsafe.Pointer(&memory[0]), a.Resolve(last))
+	assert.Equal(t, small, a.Resolve(small))
+
+	// blocks can be freed through their old address during the pass
+	assert.NoError(t, a.Free(last))
+	assert.Equal(t, 0, a.Size(last))
+
+	// the freed block is not reported, its new address may be taken again
+	ptr, err := a.Alloc(32, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[0]), ptr)
+	assert.Equal(t, last, a.Resolve(last))
+	assert.NoError(t, a.Free(ptr))
+
+	moved := d.Finish()
+	assert.Empty(t, moved)
+	assert.Equal(t, []Span{{Offset: 0, Size: 64}, {Offset: 160, Size: 96}}, a.free)
+
+	d = a.StartDefragment(32)
+	assert.False(t, d.Step())
+	assert.True(t, d.Step())
+	assert.Equal(t, map[unsafe.Pointer]unsafe.Pointer{small: unsafe.Pointer(&memory[0])}, d.Finish())
+	assert.Equal(t, 64, a.Size(large))
+	assert.NotPanics(t, func() { a.Defragment() })
+}
+
+func TestDefragmenterLargeBlock(t *testing.T) {
+	memory := alignedMemory(256)
+	a := NewAllocator(memory, FirstFit{})
+
+	first, err := a.Alloc(80, 8)
+	assert.NoError(t, err)
+	large, err := a.Alloc(64, 8)
+	assert.NoError(t, err)
+	small, err := a.Alloc(8, 8)
+	assert.NoError(t, err)
+	assert.NoError(t, a.Free(first))
+
+	d := a.StartDefragment(16)
+	assert.False(t, d.Step())
+	assert.Equal(t, unsafe.Pointer(&memory[0]), a.Resolve(small))
+	assert.Equal(t, large, a.Resolve(large))
+
+	// the block larger than the target is moved whole in a step of its own
+	assert.True(t, d.Step())
+	assert.Equal(t, unsafe.Pointer(&memory[8]), a.Resolve(large))
+
+	assert.Equal(t, map[unsafe.Pointer]unsafe.Pointer{
+		large: unsafe.Pointer(&memory[8]),
+		small: unsafe.Pointer(&memory[0]),
+	}, d.Finish())
+	assert.Equal(t, []Span{{Offset: 72, Size: 184}}, a.free)
+}
+
+func TestDefragmenterReusedOffset(t *testing.T) {
+	memory := alignedMemory(256)
+	a := NewAllocator(memory, &NextFit{})
+
+	first, err := a.Alloc(16, 8)
+	assert.NoError(t, err)
+	second, err := a.Alloc(16, 8)
+	assert.NoError(t, err)
+	third, err := a.Alloc(16, 8)
+	assert.NoError(t, err)
+	assert.NoError(t, a.Free(first))
+
+	d := a.StartDefragment(64)
+
+	// the new block takes the offset of a block the pass was going to visit,
+	// and stays there although the hole at the start would fit it
+	assert.NoError(t, a.Free(third))
+	fresh, err := a.Alloc(16, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, third, fresh)
+
+	assert.True(t, d.Step())
+	assert.Equal(t, map[unsafe.Pointer]unsafe.Pointer{second: unsafe.Pointer(&memory[0])}, d.Finish())
+	assert.Equal(t, fresh, a.Resolve(fresh))
+	assert.Equal(t, 16, a.Size(fresh))
+}
+
+func TestDefragmenterDebug(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	memory := alignedMemory(256)
+	a := NewAllocator(memory, FirstFit{})
+
+	first, err := a.Alloc(16, 8)
+	assert.NoError(t, err)
+	second, err := a.Alloc(16, 8)
+	assert.NoError(t, err)
+	copy(unsafe.Slice((*byte)(second), 16), "compacted block!")
+	assert.NoError(t, a.Free(first))
+
+	d := a.StartDefragment(64)
+	assert.True(t, d.Step())
+	assert.NoError(t, a.Verify())
+
+	ptr := a.Resolve(second)
+	assert.Equal(t, unsafe.Pointer(&memory[16]), ptr)
+	assert.Equal(t, "compacted block!", string(unsafe.Slice((*byte)(ptr), 16)))
+	assert.Equal(t, -1, mismatch(memory[48:96], poisonByte))
+
+	d.Finish()
+	assert.NoError(t, a.Verify())
+}
@@ -0,0 +1,565 @@
+//go:build linux
+
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v mmap_test.go freelist_test.go debug_test.go handles_test.go incremental_test.go
+
+var ErrNotHeap = errors.New("region does not contain a heap")
+
+// Region is memory mapped with mmap outside of the Go heap, either anonymous
+// or backed by a file.
+type Region struct {
+	memory []byte
+	file   *os.File
+}
+
+func MapAnonymous(size int) (*Region, error) {
+	memory, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	return &Region{memory: memory}, nil
+}
+
+// MapFile maps the file at path, creating it or growing it to size bytes.
+// Writes to the region are shared with the file.
+func MapFile(path string, size int) (*Region, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err == nil && info.Size() < int64(size) {
+		err = file.Truncate(int64(size))
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	memory, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Region{memory: memory, file: file}, nil
+}
+
+func (r *Region) Bytes() []byte {
+	return r.memory
+}
+
+// Sync flushes the region to its file, it does nothing for anonymous memory.
+func (r *Region) Sync() error {
+	if r.file == nil {
+		return nil
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&r.memory[0])), uintptr(len(r.memory)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (r *Region) Close() error {
+	err := syscall.Munmap(r.memory)
+	r.memory = nil
+	if r.file != nil {
+		err = errors.Join(err, r.file.Close())
+	}
+	return err
+}
+
+const (
+	heapMagic      = "GOHEAP01"
+	heapHeaderSize = 64
+	heapEntrySize  = 5 * 8
+)
+
+// PersistentHeap is a free-list heap in a Region that can be reopened. The
+// header at the start of the region points to a table of the allocations
+// written by Sync, and to a root block from which the caller finds its
+// objects again. Objects must refer to each other by offset, since the region
+// is mapped at a different address every time.
+//
+// Header layout, little endian:
+//
+//	magic [8]byte
+//	size  uint64 // bytes managed after the header
+//	root  uint64 // offset of the root block + 1, 0 without root
+//	table uint64 // offset of the allocation table + 1, 0 without table
+//	count uint64 // entries in the table
+//	debug uint64 // 1 if blocks have guard bytes
+//	moving uint64 // 1 while Defragment moves blocks
+type PersistentHeap struct {
+	region    *Region
+	allocator *Allocator
+	root      int
+	table     int
+}
+
+// CreateHeap initializes an empty heap in the region, overwriting its
+// contents.
+func CreateHeap(region *Region, strategy PlacementStrategy) (*PersistentHeap, error) {
+	if len(region.memory) <= heapHeaderSize {
+		return nil, ErrInvalidSize
+	}
+
+	h := &PersistentHeap{
+		region:    region,
+		allocator: NewAllocator(region.memory[heapHeaderSize:], strategy),
+		root:      -1,
+		table:     -1,
+	}
+	return h, h.Sync()
+}
+
+// OpenHeap restores the heap from the table written by the last Sync.
+func OpenHeap(region *Region, strategy PlacementStrategy) (*PersistentHeap, error) {
+	memory := region.memory
+	if len(memory) <= heapHeaderSize || string(memory[:8]) != heapMagic {
+		return nil, ErrNotHeap
+	}
+
+	header := func(i int) int {
+		return int(binary.LittleEndian.Uint64(memory[8+i*8:]))
+	}
+	size, root, table, count, guarded := header(0), header(1)-1, header(2)-1, header(3), header(4) == 1
+	if size != len(memory)-heapHeaderSize {
+		return nil, ErrNotHeap
+	}
+	if header(5) != 0 {
+		// blocks were moving, the table describes neither layout
+		return nil, fmt.Errorf("%w: interrupted defragmentation", ErrCorrupted)
+	}
+	if count < 0 || count > size/heapEntrySize || (count > 0) != (table != -1) {
+		return nil, ErrCorrupted
+	}
+
+	a := &Allocator{
+		memory:    memory[heapHeaderSize:],
+		allocated: map[int]allocation{},
+		strategy:  strategy,
+		debug:     guarded,
+	}
+
+	entries := make([]Span, 0, count+1)
+	if table != -1 {
+		// the table is a block of the heap itself
+		block := allocation{size: count * heapEntrySize, align: 8}
+		if guarded {
+			block.front, block.back = max(debugGuardSize, 8), debugGuardSize
+		}
+		if !block.within(table, len(a.memory)) {
+			return nil, ErrCorrupted
+		}
+		a.allocated[table] = block
+		entries = append(entries, block.span(table))
+	}
+
+	for i := range count {
+		entry := a.memory[table+i*heapEntrySize:]
+		value := func(j int) int {
+			return int(binary.LittleEndian.Uint64(entry[j*8:]))
+		}
+
+		offset := value(0)
+		block := allocation{size: value(1), align: value(2), front: value(3), back: value(4)}
+		if block.size <= 0 || block.align <= 0 || block.align&(block.align-1) != 0 || block.front < 0 || block.back < 0 {
+			return nil, ErrCorrupted
+		}
+		if !block.within(offset, len(a.memory)) {
+			return nil, ErrCorrupted
+		}
+
+		a.allocated[offset] = block
+		entries = append(entries, block.span(offset))
+	}
+	if err := a.restoreFree(entries); err != nil {
+		return nil, err
+	}
+	if _, ok := a.allocated[root]; root != -1 && (!ok || root == table) {
+		// the root must be one of the blocks in the table
+		return nil, ErrCorrupted
+	}
+
+	return &PersistentHeap{region: region, allocator: a, root: root, table: table}, nil
+}
+
+// within reports whether the block at offset and its guards lie in the first
+// length bytes, without overflowing on corrupted values. front and size must
+// not be negative.
+func (b allocation) within(offset, length int) bool {
+	return offset >= b.front && offset <= length &&
+		b.size <= length-offset && b.back <= length-offset-b.size
+}
+
+// restoreFree rebuilds the free list from the gaps between the used spans.
+func (a *Allocator) restoreFree(used []Span) error {
+	slices.SortFunc(used, func(a, b Span) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+
+	a.free = nil
+	end := 0
+	for _, span := range used {
+		if span.Offset < end {
+			return ErrCorrupted
+		}
+		if span.Offset > end {
+			a.free = append(a.free, Span{Offset: end, Size: span.Offset - end})
+		}
+		end = span.End()
+	}
+	if end < len(a.memory) {
+		a.free = append(a.free, Span{Offset: end, Size: len(a.memory) - end})
+	}
+	return nil
+}
+
+func (h *PersistentHeap) Alloc(size, align int) (unsafe.Pointer, error) {
+	return h.allocator.Alloc(size, align)
+}
+
+func (h *PersistentHeap) Free(ptr unsafe.Pointer) error {
+	offset, ok := h.allocator.offset(ptr)
+	if ok && offset == h.root {
+		h.root = -1
+	}
+	return h.allocator.Free(ptr)
+}
+
+// Offset returns the position of ptr in the heap that stays valid when the
+// heap is reopened, or -1 if ptr is outside of it.
+func (h *PersistentHeap) Offset(ptr unsafe.Pointer) int {
+	offset, ok := h.allocator.offset(ptr)
+	if !ok {
+		return -1
+	}
+	return offset
+}
+
+// Pointer returns the address of offset in the current mapping.
+func (h *PersistentHeap) Pointer(offset int) unsafe.Pointer {
+	if offset < 0 || offset >= len(h.allocator.memory) {
+		return nil
+	}
+	return unsafe.Pointer(&h.allocator.memory[offset])
+}
+
+func (h *PersistentHeap) SetRoot(ptr unsafe.Pointer) {
+	h.root = h.Offset(ptr)
+}
+
+func (h *PersistentHeap) Root() unsafe.Pointer {
+	if h.root == -1 {
+		return nil
+	}
+	return h.Pointer(h.root)
+}
+
+// Defragment compacts the heap, syncs it and returns the new offset of each
+// moved block. The root follows its block. Blocks are moved in place, so a
+// crash while they move cannot be recovered: the header marks the move
+// before it starts, and OpenHeap refuses such a heap instead of trusting a
+// table that no longer describes it.
+func (h *PersistentHeap) Defragment() (map[int]int, error) {
+	if h.allocator.forward != nil {
+		return nil, errors.New("incremental defragmentation in progress")
+	}
+	if err := h.setMoving(true); err != nil {
+		return nil, err
+	}
+
+	moved := map[int]int{}
+	for from, to := range h.allocator.Defragment() {
+		moved[h.Offset(from)] = h.Offset(to)
+	}
+
+	if to, ok := moved[h.root]; ok {
+		h.root = to
+	}
+	if to, ok := moved[h.table]; ok {
+		h.table = to
+	}
+
+	// the new table and header clear the mark
+	return moved, h.Sync()
+}
+
+// setMoving writes the moving word of the header and flushes it.
+func (h *PersistentHeap) setMoving(moving bool) error {
+	var value uint64
+	if moving {
+		value = 1
+	}
+	binary.LittleEndian.PutUint64(h.region.memory[8+5*8:], value)
+	return h.region.Sync()
+}
+
+func (h *PersistentHeap) Stats() Stats {
+	return h.allocator.Stats()
+}
+
+// Sync writes the allocation table and the header and flushes the region.
+// The previous table stays valid until the new header is written, except
+// while Defragment moves blocks.
+func (h *PersistentHeap) Sync() error {
+	a := h.allocator
+	if a.forward != nil {
+		return errors.New("incremental defragmentation in progress")
+	}
+
+	previous := h.table
+	count := len(a.allocated)
+	if previous != -1 {
+		// the previous table is not part of the new one
+		count--
+	}
+
+	table := -1
+	if count > 0 {
+		ptr, err := a.Alloc(count*heapEntrySize, 8)
+		if err != nil {
+			return err
+		}
+		table = h.Offset(ptr)
+
+		i := 0
+		for offset, block := range a.allocated {
+			if offset == previous || offset == table {
+				continue
+			}
+			entry := a.memory[table+i*heapEntrySize:]
+			for j, value := range []int{offset, block.size, block.align, block.front, block.back} {
+				binary.LittleEndian.PutUint64(entry[j*8:], uint64(value))
+			}
+			i++
+		}
+		if err := h.region.Sync(); err != nil {
+			return err
+		}
+	}
+
+	header := h.region.memory[:heapHeaderSize]
+	copy(header, heapMagic)
+	var debug int
+	if a.debug {
+		debug = 1
+	}
+	for i, value := range []int{len(a.memory), h.root + 1, table + 1, count, debug, 0} {
+		binary.LittleEndian.PutUint64(header[8+i*8:], uint64(value))
+	}
+	if err := h.region.Sync(); err != nil {
+		return err
+	}
+
+	if previous != -1 {
+		if err := a.Free(h.Pointer(previous)); err != nil {
+			return err
+		}
+	}
+	h.table = table
+	return nil
+}
+
+// Close syncs the heap and unmaps its region.
+func (h *PersistentHeap) Close() error {
+	return errors.Join(h.Sync(), h.region.Close())
+}
+
+func TestMapAnonymous(t *testing.T) {
+	region, err := MapAnonymous(1 << 16)
+	assert.NoError(t, err)
+	defer region.Close()
+
+	a := NewAllocator(region.Bytes(), FirstFit{})
+	ptr, err := a.Alloc(100, 64)
+	assert.NoError(t, err)
+	assert.Zero(t, uintptr(ptr)%64)
+
+	copy(unsafe.Slice((*byte)(ptr), 5), "mmap!")
+	assert.Equal(t, "mmap!", string(region.Bytes()[:5]))
+	assert.NoError(t, region.Sync())
+}
+
+type persistentNode struct {
+	Value int64
+	Next  int64 // offset of the next node, -1 at the end
+}
+
+func TestPersistentHeap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap")
+
+	region, err := MapFile(path, 1<<16)
+	assert.NoError(t, err)
+	h, err := CreateHeap(region, FirstFit{})
+	assert.NoError(t, err)
+
+	// a linked list whose nodes are separated by a freed gap
+	size, align := int(unsafe.Sizeof(persistentNode{})), int(unsafe.Alignof(persistentNode{}))
+	next := int64(-1)
+	for i := range 3 {
+		gap, err := h.Alloc(32, 8)
+		assert.NoError(t, err)
+
+		ptr, err := h.Alloc(size, align)
+		assert.NoError(t, err)
+		*(*persistentNode)(ptr) = persistentNode{Value: int64(i), Next: next}
+		next = int64(h.Offset(ptr))
+
+		assert.NoError(t, h.Free(gap))
+	}
+	h.SetRoot(h.Pointer(int(next)))
+	stats := h.Stats()
+	assert.NoError(t, h.Close())
+
+	region, err = MapFile(path, 1<<16)
+	assert.NoError(t, err)
+	h, err = OpenHeap(region, FirstFit{})
+	assert.NoError(t, err)
+	assert.Equal(t, stats.Allocations+1, h.Stats().Allocations)
+
+	values := func() []int64 {
+		var values []int64
+		for ptr := h.Root(); ptr != nil; {
+			node := (*persistentNode)(ptr)
+			values = append(values, node.Value)
+			ptr = h.Pointer(int(node.Next))
+		}
+		return values
+	}
+	assert.Equal(t, []int64{2, 1, 0}, values())
+
+	// defragmentation works on offsets, links are updated by the caller
+	moved, err := h.Defragment()
+	assert.NoError(t, err)
+
+	// the file already describes the compacted layout, without Close
+	other, err := MapFile(path, 1<<16)
+	assert.NoError(t, err)
+	reopened, err := OpenHeap(other, FirstFit{})
+	assert.NoError(t, err)
+	assert.Equal(t, h.Stats(), reopened.Stats())
+	assert.Equal(t, h.root, reopened.root)
+	assert.NoError(t, other.Close())
+
+	for ptr := h.Root(); ptr != nil; {
+		node := (*persistentNode)(ptr)
+		if to, ok := moved[int(node.Next)]; ok {
+			node.Next = int64(to)
+		}
+		ptr = h.Pointer(int(node.Next))
+	}
+	assert.Equal(t, []int64{2, 1, 0}, values())
+	assert.NoError(t, h.Close())
+
+	region, err = MapFile(path, 1<<16)
+	assert.NoError(t, err)
+	h, err = OpenHeap(region, FirstFit{})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2, 1, 0}, values())
+	assert.NoError(t, h.Close())
+}
+
+func TestOpenHeapErrors(t *testing.T) {
+	region, err := MapAnonymous(4096)
+	assert.NoError(t, err)
+	defer region.Close()
+
+	_, err = OpenHeap(region, FirstFit{})
+	assert.ErrorIs(t, err, ErrNotHeap)
+
+	h, err := CreateHeap(region, FirstFit{})
+	assert.NoError(t, err)
+	_, err = h.Alloc(16, 8)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Sync())
+
+	_, err = OpenHeap(region, FirstFit{})
+	assert.NoError(t, err)
+
+	// an entry is offset, size, align, front and back
+	corruptions := map[string]struct {
+		field int
+		value int64
+	}{
+		"outside of the heap": {field: 0, value: 1 << 20},
+		"zero size":           {field: 1, value: 0},
+		"negative size":       {field: 1, value: -16},
+		"zero align":          {field: 2, value: 0},
+		"odd align":           {field: 2, value: 3},
+		"negative front":      {field: 3, value: -8},
+		"negative back":       {field: 4, value: -8},
+		"offset overflows":    {field: 0, value: math.MaxInt64 - 8},
+		"size overflows":      {field: 1, value: math.MaxInt64},
+		"back overflows":      {field: 4, value: math.MaxInt64 - 8},
+	}
+	for name, corruption := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			word := region.Bytes()[heapHeaderSize+h.table+corruption.field*8:]
+			saved := binary.LittleEndian.Uint64(word)
+			defer binary.LittleEndian.PutUint64(word, saved)
+
+			binary.LittleEndian.PutUint64(word, uint64(corruption.value))
+			_, err := OpenHeap(region, FirstFit{})
+			assert.ErrorIs(t, err, ErrCorrupted)
+		})
+	}
+
+	// the header is size, root, table, count, guarded and moving
+	headers := map[string]struct {
+		field int
+		value int64
+	}{
+		"huge count":       {field: 3, value: 1 << 62},
+		"negative count":   {field: 3, value: -1},
+		"table outside":    {field: 2, value: 1 << 20},
+		"table overflows":  {field: 2, value: math.MaxInt64},
+		"empty table":      {field: 3, value: 0},
+		"root not a block": {field: 1, value: int64(h.table) + 9},
+		"root is table":    {field: 1, value: int64(h.table) + 1},
+		"negative root":    {field: 1, value: -8},
+	}
+	for name, corruption := range headers {
+		t.Run(name, func(t *testing.T) {
+			word := region.Bytes()[8+corruption.field*8:]
+			saved := binary.LittleEndian.Uint64(word)
+			defer binary.LittleEndian.PutUint64(word, saved)
+
+			binary.LittleEndian.PutUint64(word, uint64(corruption.value))
+			_, err := OpenHeap(region, FirstFit{})
+			assert.ErrorIs(t, err, ErrCorrupted)
+		})
+	}
+
+	// a crash while Defragment moves blocks
+	assert.NoError(t, h.setMoving(true))
+	_, err = OpenHeap(region, FirstFit{})
+	assert.ErrorIs(t, err, ErrCorrupted)
+	assert.NoError(t, h.setMoving(false))
+	_, err = OpenHeap(region, FirstFit{})
+	assert.NoError(t, err)
+
+	_, err = MapAnonymous(0)
+	assert.Error(t, err)
+}
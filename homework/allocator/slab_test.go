@@ -0,0 +1,706 @@
+package main
+
+import (
+	"cmp"
+	"math/bits"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v slab_test.go buddy_test.go freelist_test.go debug_test.go handles_test.go
+
+const (
+	slabPageSize = 8192
+	slabMaxPages = 8
+)
+
+// slabSizeClasses are the small object size classes of the Go runtime
+// (runtime/sizeclasses.go).
+var slabSizeClasses = []int{
+	8, 16, 24, 32, 48, 64, 80, 96, 112, 128, 144, 160, 176, 192, 208, 224,
+	240, 256, 288, 320, 352, 384, 416, 448, 480, 512, 576, 640, 704, 768, 896,
+	1024, 1152, 1280, 1408, 1536, 1792, 2048, 2304, 2688, 3072, 3200, 3456,
+	4096, 4864, 5376, 6144, 6528, 6784, 6912, 8192, 9472, 9728, 10240, 10880,
+	12288, 13568, 14336, 16384, 18432, 19072, 20480, 21760, 24576, 27264,
+	28672, 32768,
+}
+
+// SlabAllocator serves small objects from slabs of pages, every slab holds
+// objects of a single size class and tracks free slots in a bitmap. Pages are
+// taken from the region with a first fit Allocator and returned when a slab
+// becomes empty.
+//
+// Alloc and Free are safe for concurrent use. Alloc goes through the central
+// per-class lists under a lock, a SlabCache owned by a single goroutine
+// allocates from its own slabs without locking.
+//
+// In debug mode (see SetDebug) free slots are poisoned and every object is
+// followed by at least debugGuardSize guard bytes in its slot.
+type SlabAllocator struct {
+	memory  []byte
+	mu      sync.Mutex
+	pages   *Allocator
+	spans   []atomic.Pointer[slab]
+	classes []slabClass
+	debug   bool
+}
+
+type slabClass struct {
+	mu        sync.Mutex
+	size      int
+	pages     int
+	slabs     []*slab
+	requested atomic.Int64
+}
+
+type slab struct {
+	offset  int
+	class   int
+	objects int
+	bitmap  []atomic.Uint64
+	used    atomic.Int32
+	sizes   []int32
+	owner   *SlabCache
+}
+
+func newSlab(offset, class, objects int) *slab {
+	s := &slab{
+		offset:  offset,
+		class:   class,
+		objects: objects,
+		bitmap:  make([]atomic.Uint64, (objects+63)/64),
+		sizes:   make([]int32, objects),
+	}
+	if tail := objects % 64; tail != 0 {
+		// slots past the end of the slab are never handed out
+		s.bitmap[len(s.bitmap)-1].Store(^uint64(0) << tail)
+	}
+	return s
+}
+
+func (s *slab) alloc() (int, bool) {
+	for i := range s.bitmap {
+		for {
+			old := s.bitmap[i].Load()
+			if old == ^uint64(0) {
+				break
+			}
+
+			bit := bits.TrailingZeros64(^old)
+			if s.bitmap[i].CompareAndSwap(old, old|1<<bit) {
+				s.used.Add(1)
+				return i*64 + bit, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (s *slab) free(slot int) bool {
+	word := &s.bitmap[slot/64]
+	mask := uint64(1) << (slot % 64)
+	for {
+		old := word.Load()
+		if old&mask == 0 {
+			return false
+		}
+		if word.CompareAndSwap(old, old&^mask) {
+			s.used.Add(-1)
+			return true
+		}
+	}
+}
+
+func (s *slab) allocated(slot int) bool {
+	return s.bitmap[slot/64].Load()&(1<<(slot%64)) != 0
+}
+
+func (s *slab) full() bool {
+	return int(s.used.Load()) == s.objects
+}
+
+func NewSlabAllocator(memory []byte) *SlabAllocator {
+	pages := NewAllocator(memory, FirstFit{})
+	s := &SlabAllocator{
+		memory:  memory,
+		pages:   pages,
+		spans:   make([]atomic.Pointer[slab], len(memory)/slabPageSize),
+		classes: make([]slabClass, len(slabSizeClasses)),
+		debug:   pages.debug,
+	}
+	// slabs are found by page index, guard bytes would shift them off pages
+	pages.debug = false
+
+	for i, size := range slabSizeClasses {
+		s.classes[i].size = size
+		s.classes[i].pages = slabPages(size)
+	}
+
+	return s
+}
+
+// slabPages returns the smallest slab length in pages that wastes at most
+// 1/8 of the slab on the tail that does not fit an object.
+func slabPages(size int) int {
+	for pages := 1; pages < slabMaxPages; pages++ {
+		length := pages * slabPageSize
+		if length >= size && (length%size)*8 <= length {
+			return pages
+		}
+	}
+	return slabMaxPages
+}
+
+// sizeClass returns the smallest class that fits size bytes with the given
+// alignment.
+func sizeClass(size, align int) (int, bool) {
+	if size <= 0 || !isPowerOfTwo(align) {
+		return 0, false
+	}
+
+	i, _ := slices.BinarySearch(slabSizeClasses, size)
+	for ; i < len(slabSizeClasses); i++ {
+		if slabSizeClasses[i]%align == 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (s *SlabAllocator) Alloc(size, align int) (unsafe.Pointer, error) {
+	class, ok := s.sizeClass(size, align)
+	if !ok {
+		return nil, ErrInvalidSize
+	}
+
+	c := &s.classes[class]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, sl := range c.slabs {
+		if sl.owner != nil {
+			continue
+		}
+		if slot, ok := sl.alloc(); ok {
+			return s.pointer(sl, slot, size), nil
+		}
+	}
+
+	sl, err := s.grow(class)
+	if err != nil {
+		return nil, err
+	}
+
+	slot, _ := sl.alloc()
+	return s.pointer(sl, slot, size), nil
+}
+
+// Free releases the object at ptr. In debug mode the guard bytes are
+// verified first and a *CorruptionError is returned without releasing the
+// object if they were overwritten.
+func (s *SlabAllocator) Free(ptr unsafe.Pointer) error {
+	if ptr == nil || len(s.memory) == 0 {
+		return ErrInvalidPointer
+	}
+
+	offset := uintptr(ptr) - uintptr(unsafe.Pointer(&s.memory[0]))
+	if offset >= uintptr(len(s.spans)*slabPageSize) {
+		return ErrInvalidPointer
+	}
+
+	sl := s.spans[offset/slabPageSize].Load()
+	if sl == nil {
+		return ErrInvalidPointer
+	}
+
+	c := &s.classes[sl.class]
+	index := int(offset) - sl.offset
+	if index%c.size != 0 {
+		return ErrInvalidPointer
+	}
+
+	slot := index / c.size
+	if slot >= sl.objects {
+		// the tail of the slab that does not fit an object
+		return ErrInvalidPointer
+	}
+	requested := sl.sizes[slot]
+	if s.debug && sl.allocated(slot) {
+		if err := s.verifySlot(sl, slot); err != nil {
+			return err
+		}
+		poison(s.memory[int(offset) : int(offset)+c.size])
+	}
+	if !sl.free(slot) {
+		return ErrInvalidPointer
+	}
+	c.requested.Add(-int64(requested))
+
+	if sl.used.Load() == 0 {
+		c.mu.Lock()
+		if sl.owner == nil {
+			s.release(sl)
+		}
+		c.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Verify checks the guard bytes of every object and that free slots are
+// still poisoned. It reports the first corruption found in address order and
+// must not run concurrently with Alloc or Free. Without debug mode there is
+// nothing to verify.
+func (s *SlabAllocator) Verify() error {
+	if !s.debug {
+		return nil
+	}
+
+	var slabs []*slab
+	for i := range s.classes {
+		c := &s.classes[i]
+		c.mu.Lock()
+		slabs = append(slabs, c.slabs...)
+		c.mu.Unlock()
+	}
+	slices.SortFunc(slabs, func(a, b *slab) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+
+	for _, sl := range slabs {
+		size := s.classes[sl.class].size
+		for slot := range sl.objects {
+			if sl.allocated(slot) {
+				if err := s.verifySlot(sl, slot); err != nil {
+					return err
+				}
+				continue
+			}
+
+			span := Span{Offset: sl.offset + slot*size, Size: size}
+			if i := mismatch(s.memory[span.Offset:span.End()], poisonByte); i != -1 {
+				return &CorruptionError{Block: span, Offset: span.Offset + i, Reason: "write after free"}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SlabAllocator) verifySlot(sl *slab, slot int) error {
+	span := Span{Offset: sl.offset + slot*s.classes[sl.class].size, Size: s.classes[sl.class].size}
+	end := span.Offset + int(sl.sizes[slot])
+	if i := mismatch(s.memory[end:span.End()], canaryByte); i != -1 {
+		return &CorruptionError{Block: span, Offset: end + i, Reason: "back guard overwritten"}
+	}
+	return nil
+}
+
+// NewCache returns a cache of slabs for a single goroutine.
+func (s *SlabAllocator) NewCache() *SlabCache {
+	return &SlabCache{
+		allocator: s,
+		slabs:     make([]*slab, len(s.classes)),
+	}
+}
+
+type ClassUtilization struct {
+	Size      int
+	Slabs     int
+	Capacity  int // object slots
+	Allocated int // object slots in use
+	Requested int // bytes asked for by callers
+}
+
+func (u ClassUtilization) Utilization() float64 {
+	if u.Capacity == 0 {
+		return 0
+	}
+	return float64(u.Allocated) / float64(u.Capacity)
+}
+
+// InternalFragmentation is the share of allocated slot bytes that callers did
+// not ask for.
+func (u ClassUtilization) InternalFragmentation() float64 {
+	if u.Allocated == 0 {
+		return 0
+	}
+	return 1 - float64(u.Requested)/float64(u.Allocated*u.Size)
+}
+
+// Utilization reports every size class that currently owns slabs.
+func (s *SlabAllocator) Utilization() []ClassUtilization {
+	var result []ClassUtilization
+	for i := range s.classes {
+		c := &s.classes[i]
+		c.mu.Lock()
+		if len(c.slabs) > 0 {
+			u := ClassUtilization{
+				Size:      c.size,
+				Slabs:     len(c.slabs),
+				Requested: int(c.requested.Load()),
+			}
+			for _, sl := range c.slabs {
+				u.Capacity += sl.objects
+				u.Allocated += int(sl.used.Load())
+			}
+			result = append(result, u)
+		}
+		c.mu.Unlock()
+	}
+	return result
+}
+
+// Stats reports page level usage, Allocations counts objects.
+func (s *SlabAllocator) Stats() Stats {
+	s.mu.Lock()
+	stats := s.pages.Stats()
+	s.mu.Unlock()
+
+	stats.Allocations = 0
+	for _, u := range s.Utilization() {
+		stats.Allocations += u.Allocated
+	}
+	return stats
+}
+
+func (s *SlabAllocator) sizeClass(size, align int) (int, bool) {
+	if uintptr(unsafe.Pointer(unsafe.SliceData(s.memory)))%uintptr(max(align, 1)) != 0 {
+		return 0, false
+	}
+	if s.debug && size > 0 {
+		size += debugGuardSize
+	}
+	return sizeClass(size, align)
+}
+
+func (s *SlabAllocator) pointer(sl *slab, slot, size int) unsafe.Pointer {
+	c := &s.classes[sl.class]
+	sl.sizes[slot] = int32(size)
+	c.requested.Add(int64(size))
+
+	start := sl.offset + slot*c.size
+	if s.debug {
+		guard(s.memory[start+size : start+c.size])
+	}
+	return unsafe.Pointer(&s.memory[start])
+}
+
+// grow maps a new slab for class, the class lock must be held.
+func (s *SlabAllocator) grow(class int) (*slab, error) {
+	c := &s.classes[class]
+	length := c.pages * slabPageSize
+
+	s.mu.Lock()
+	ptr, err := s.pages.Alloc(length, 1)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := int(uintptr(ptr) - uintptr(unsafe.Pointer(&s.memory[0])))
+	sl := newSlab(offset, class, length/c.size)
+	for page := range c.pages {
+		s.spans[offset/slabPageSize+page].Store(sl)
+	}
+	c.slabs = append(c.slabs, sl)
+
+	return sl, nil
+}
+
+// release returns an empty slab to the page allocator, the class lock must be
+// held.
+func (s *SlabAllocator) release(sl *slab) {
+	c := &s.classes[sl.class]
+	i := slices.Index(c.slabs, sl)
+	if i == -1 || sl.used.Load() != 0 {
+		return
+	}
+	c.slabs = slices.Delete(c.slabs, i, i+1)
+
+	for page := range c.pages {
+		s.spans[sl.offset/slabPageSize+page].Store(nil)
+	}
+
+	s.mu.Lock()
+	_ = s.pages.Free(unsafe.Pointer(&s.memory[sl.offset]))
+	s.mu.Unlock()
+}
+
+// SlabCache holds one slab per size class for exclusive use by a single
+// goroutine, like the mcache of a P in the Go runtime. It is not safe for
+// concurrent use, objects allocated from it may be freed by any goroutine
+// through the SlabAllocator.
+type SlabCache struct {
+	allocator *SlabAllocator
+	slabs     []*slab
+}
+
+func (c *SlabCache) Alloc(size, align int) (unsafe.Pointer, error) {
+	s := c.allocator
+	class, ok := s.sizeClass(size, align)
+	if !ok {
+		return nil, ErrInvalidSize
+	}
+
+	if sl := c.slabs[class]; sl != nil {
+		if slot, ok := sl.alloc(); ok {
+			return s.pointer(sl, slot, size), nil
+		}
+	}
+
+	sl, err := c.refill(class)
+	if err != nil {
+		return nil, err
+	}
+
+	slot, _ := sl.alloc()
+	return s.pointer(sl, slot, size), nil
+}
+
+// Flush hands all cached slabs back to the central lists.
+func (c *SlabCache) Flush() {
+	for class, sl := range c.slabs {
+		if sl == nil {
+			continue
+		}
+
+		central := &c.allocator.classes[class]
+		central.mu.Lock()
+		sl.owner = nil
+		c.allocator.release(sl)
+		central.mu.Unlock()
+
+		c.slabs[class] = nil
+	}
+}
+
+func (c *SlabCache) refill(class int) (*slab, error) {
+	s := c.allocator
+	central := &s.classes[class]
+	central.mu.Lock()
+	defer central.mu.Unlock()
+
+	if sl := c.slabs[class]; sl != nil {
+		sl.owner = nil
+		c.slabs[class] = nil
+	}
+
+	for _, sl := range central.slabs {
+		if sl.owner == nil && !sl.full() {
+			sl.owner = c
+			c.slabs[class] = sl
+			return sl, nil
+		}
+	}
+
+	sl, err := s.grow(class)
+	if err != nil {
+		return nil, err
+	}
+	sl.owner = c
+	c.slabs[class] = sl
+
+	return sl, nil
+}
+
+func TestSizeClass(t *testing.T) {
+	tests := map[string]struct {
+		size  int
+		align int
+		class int
+		ok    bool
+	}{
+		"smallest":            {size: 1, align: 1, class: 8, ok: true},
+		"exact":               {size: 8, align: 8, class: 8, ok: true},
+		"round up":            {size: 33, align: 1, class: 48, ok: true},
+		"alignment skips 24":  {size: 17, align: 16, class: 32, ok: true},
+		"alignment skips 48":  {size: 33, align: 64, class: 64, ok: true},
+		"largest":             {size: 32768, align: 8, class: 32768, ok: true},
+		"too large":           {size: 32769, align: 1},
+		"zero":                {size: 0, align: 1},
+		"invalid alignment":   {size: 8, align: 3},
+		"alignment too large": {size: 8, align: 65536},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			class, ok := sizeClass(test.size, test.align)
+			assert.Equal(t, test.ok, ok)
+			if ok {
+				assert.Equal(t, test.class, slabSizeClasses[class])
+			}
+		})
+	}
+}
+
+func TestSlabPages(t *testing.T) {
+	assert.Equal(t, 1, slabPages(8))
+	assert.Equal(t, 1, slabPages(8192))
+	assert.Equal(t, 5, slabPages(9472))
+	assert.Equal(t, 4, slabPages(32768))
+	for _, size := range slabSizeClasses {
+		length := slabPages(size) * slabPageSize
+		assert.LessOrEqual(t, (length%size)*8, length, size)
+	}
+}
+
+func TestSlabAllocator(t *testing.T) {
+	memory := alignedMemory(8 * slabPageSize)
+	s := NewSlabAllocator(memory)
+
+	p1, err := s.Alloc(20, 8)
+	assert.NoError(t, err)
+	p2, err := s.Alloc(24, 8)
+	assert.NoError(t, err)
+	p3, err := s.Alloc(100, 8)
+	assert.NoError(t, err)
+
+	assert.Equal(t, unsafe.Pointer(&memory[0]), p1)
+	assert.Equal(t, unsafe.Pointer(&memory[24]), p2)
+	assert.Equal(t, unsafe.Pointer(&memory[slabPageSize]), p3)
+
+	assert.Equal(t, []ClassUtilization{
+		{Size: 24, Slabs: 1, Capacity: 341, Allocated: 2, Requested: 44},
+		{Size: 112, Slabs: 1, Capacity: 73, Allocated: 1, Requested: 100},
+	}, s.Utilization())
+
+	u := s.Utilization()[0]
+	assert.InDelta(t, 2.0/341, u.Utilization(), 1e-9)
+	assert.InDelta(t, 1-44.0/48, u.InternalFragmentation(), 1e-9)
+
+	stats := s.Stats()
+	assert.Equal(t, 2*slabPageSize, stats.Used)
+	assert.Equal(t, 3, stats.Allocations)
+
+	assert.ErrorIs(t, s.Free(unsafe.Pointer(&memory[1])), ErrInvalidPointer)
+	assert.ErrorIs(t, s.Free(unsafe.Pointer(&memory[4*slabPageSize])), ErrInvalidPointer)
+	// 341 objects of 24 bytes leave an 8 byte tail at the end of the page
+	assert.ErrorIs(t, s.Free(unsafe.Pointer(&memory[slabPageSize-8])), ErrInvalidPointer)
+
+	// empty slabs go back to the page allocator
+	assert.NoError(t, s.Free(p3))
+	assert.ErrorIs(t, s.Free(p3), ErrInvalidPointer)
+	assert.NoError(t, s.Free(p1))
+	assert.Equal(t, []ClassUtilization{
+		{Size: 24, Slabs: 1, Capacity: 341, Allocated: 1, Requested: 24},
+	}, s.Utilization())
+	assert.NoError(t, s.Free(p2))
+	assert.Empty(t, s.Utilization())
+	assert.Zero(t, s.Stats().Used)
+
+	_, err = s.Alloc(40000, 8)
+	assert.ErrorIs(t, err, ErrInvalidSize)
+}
+
+func TestSlabAllocatorOutOfMemory(t *testing.T) {
+	memory := alignedMemory(2 * slabPageSize)
+	s := NewSlabAllocator(memory)
+
+	for range 2 * slabPageSize / 4096 {
+		_, err := s.Alloc(4096, 8)
+		assert.NoError(t, err)
+	}
+
+	_, err := s.Alloc(4096, 8)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	_, err = s.Alloc(8, 8)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+}
+
+func TestSlabAllocatorDebug(t *testing.T) {
+	defer SetDebug(SetDebug(true))
+
+	memory := alignedMemory(2 * slabPageSize)
+	s := NewSlabAllocator(memory)
+
+	// the guard bytes move the object up to the 48 byte class
+	first, err := s.Alloc(20, 8)
+	assert.NoError(t, err)
+	second, err := s.Alloc(20, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(&memory[48]), second)
+	assert.Equal(t, -1, mismatch(memory[20:48], canaryByte))
+	assert.NoError(t, s.Verify())
+
+	memory[20] = 0
+	assert.Equal(t, &CorruptionError{Block: Span{Offset: 0, Size: 48}, Offset: 20, Reason: "back guard overwritten"}, s.Verify())
+	assert.ErrorIs(t, s.Free(first), ErrCorrupted)
+	assert.Equal(t, 2, s.Stats().Allocations)
+
+	memory[20] = canaryByte
+	assert.NoError(t, s.Free(first))
+	assert.Equal(t, -1, mismatch(memory[:48], poisonByte))
+	assert.NoError(t, s.Verify())
+
+	*(*byte)(first) = 1
+	assert.Equal(t, &CorruptionError{Block: Span{Offset: 0, Size: 48}, Offset: 0, Reason: "write after free"}, s.Verify())
+}
+
+func TestSlabCache(t *testing.T) {
+	memory := alignedMemory(256 * slabPageSize)
+	s := NewSlabAllocator(memory)
+
+	const workers = 8
+	const objects = 1000
+
+	var wg sync.WaitGroup
+	for worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			cache := s.NewCache()
+			defer cache.Flush()
+
+			var pointers []unsafe.Pointer
+			for i := range objects {
+				ptr, err := cache.Alloc(8+i%64, 8)
+				if !assert.NoError(t, err) {
+					return
+				}
+				*(*byte)(ptr) = byte(worker)
+				pointers = append(pointers, ptr)
+			}
+
+			for _, ptr := range pointers {
+				assert.Equal(t, byte(worker), *(*byte)(ptr))
+				assert.NoError(t, s.Free(ptr))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Empty(t, s.Utilization())
+	assert.Zero(t, s.Stats().Used)
+}
+
+func BenchmarkSlabAllocator(b *testing.B) {
+	memory := alignedMemory(1024 * slabPageSize)
+
+	b.Run("central", func(b *testing.B) {
+		s := NewSlabAllocator(memory)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ptr, _ := s.Alloc(64, 8)
+				_ = s.Free(ptr)
+			}
+		})
+	})
+
+	b.Run("cache", func(b *testing.B) {
+		s := NewSlabAllocator(memory)
+		b.RunParallel(func(pb *testing.PB) {
+			cache := s.NewCache()
+			defer cache.Flush()
+			for pb.Next() {
+				ptr, _ := cache.Alloc(64, 8)
+				_ = s.Free(ptr)
+			}
+		})
+	})
+}
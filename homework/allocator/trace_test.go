@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v trace_test.go buddy_test.go slab_test.go freelist_test.go debug_test.go handles_test.go
+
+var ErrInvalidTrace = errors.New("invalid allocation trace")
+
+// Heap is implemented by every allocator of the package that frees single
+// blocks.
+type Heap interface {
+	Alloc(size, align int) (unsafe.Pointer, error)
+	Free(ptr unsafe.Pointer) error
+	Stats() Stats
+}
+
+type defragmenter interface {
+	Defragment() map[unsafe.Pointer]unsafe.Pointer
+}
+
+type TraceOp byte
+
+const (
+	traceSite TraceOp = iota // defines the next call site
+	TraceAlloc
+	TraceFree
+	TraceDefragment
+)
+
+const (
+	traceMagic   = "ATRC\x01"
+	maxTraceSite = 4096 // longest call site name in bytes
+)
+
+var traceOperands = map[TraceOp]int{TraceAlloc: 3, TraceFree: 1, TraceDefragment: 0}
+
+// TraceEvent is a recorded call. Allocations are numbered from 1 in the order
+// they succeeded, ID 0 marks a failed Alloc or a Free of an unknown pointer.
+type TraceEvent struct {
+	Op    TraceOp
+	ID    uint64
+	Size  int
+	Align int
+	Time  time.Duration // since the start of the trace
+	Site  string
+}
+
+// Tracer forwards calls to a Heap and records them. Records are a kind byte
+// followed by uvarints: the time since the previous record in nanoseconds,
+// the call site index and the operands. A call site is written once, as a
+// string, before the first record that refers to it.
+type Tracer struct {
+	heap  Heap
+	w     *bufio.Writer
+	buf   []byte
+	start time.Time
+	last  time.Duration
+	ids   map[unsafe.Pointer]uint64
+	next  uint64
+	sites map[uintptr]uint64
+	err   error
+}
+
+func NewTracer(heap Heap, w io.Writer) *Tracer {
+	t := &Tracer{
+		heap:  heap,
+		w:     bufio.NewWriter(w),
+		start: time.Now(),
+		ids:   map[unsafe.Pointer]uint64{},
+		sites: map[uintptr]uint64{},
+	}
+	_, t.err = t.w.WriteString(traceMagic)
+	return t
+}
+
+func (t *Tracer) Alloc(size, align int) (unsafe.Pointer, error) {
+	ptr, err := t.heap.Alloc(size, align)
+
+	var id uint64
+	if err == nil {
+		t.next++
+		id = t.next
+		t.ids[ptr] = id
+	}
+	t.record(TraceAlloc, id, uint64(size), uint64(align))
+
+	return ptr, err
+}
+
+func (t *Tracer) Free(ptr unsafe.Pointer) error {
+	err := t.heap.Free(ptr)
+
+	var id uint64
+	if err == nil {
+		id = t.ids[ptr]
+		delete(t.ids, ptr)
+	}
+	t.record(TraceFree, id)
+
+	return err
+}
+
+// Defragment compacts the heap if it supports it, otherwise it returns nil.
+// The call is recorded either way, Replay skips it for heaps without
+// Defragment.
+func (t *Tracer) Defragment() map[unsafe.Pointer]unsafe.Pointer {
+	d, ok := t.heap.(defragmenter)
+	if !ok {
+		t.record(TraceDefragment)
+		return nil
+	}
+
+	moved := d.Defragment()
+	ids := make(map[unsafe.Pointer]uint64, len(t.ids))
+	for ptr, id := range t.ids {
+		if to, ok := moved[ptr]; ok {
+			ptr = to
+		}
+		ids[ptr] = id
+	}
+	t.ids = ids
+	t.record(TraceDefragment)
+
+	return moved
+}
+
+func (t *Tracer) Stats() Stats {
+	return t.heap.Stats()
+}
+
+// Flush writes buffered records and returns the first write error.
+func (t *Tracer) Flush() error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.w.Flush()
+}
+
+func (t *Tracer) record(op TraceOp, operands ...uint64) {
+	now := time.Since(t.start)
+	site := t.site()
+
+	t.buf = append(t.buf[:0], byte(op))
+	t.buf = binary.AppendUvarint(t.buf, uint64(now-t.last))
+	t.buf = binary.AppendUvarint(t.buf, site)
+	for _, operand := range operands {
+		t.buf = binary.AppendUvarint(t.buf, operand)
+	}
+	t.last = now
+
+	t.write(t.buf)
+}
+
+// site returns the index of the caller of the traced method.
+func (t *Tracer) site() uint64 {
+	pc, _, _, _ := runtime.Caller(3)
+	if index, ok := t.sites[pc]; ok {
+		return index
+	}
+
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	name := fmt.Sprintf("%s %s:%d", frame.Function, filepath.Base(frame.File), frame.Line)
+
+	index := uint64(len(t.sites))
+	t.sites[pc] = index
+	t.write(siteRecord(name))
+	return index
+}
+
+// siteRecord returns the record defining a call site, names are truncated to
+// maxTraceSite bytes.
+func siteRecord(name string) []byte {
+	name = name[:min(len(name), maxTraceSite)]
+	buf := binary.AppendUvarint([]byte{byte(traceSite)}, uint64(len(name)))
+	return append(buf, name...)
+}
+
+func (t *Tracer) write(b []byte) {
+	if t.err == nil {
+		_, t.err = t.w.Write(b)
+	}
+}
+
+// ReadTrace decodes all events written by a Tracer.
+func ReadTrace(r io.Reader) ([]TraceEvent, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(traceMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != traceMagic {
+		return nil, ErrInvalidTrace
+	}
+
+	var events []TraceEvent
+	var sites []string
+	var now time.Duration
+	for {
+		op, err := br.ReadByte()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if TraceOp(op) == traceSite {
+			length, err := binary.ReadUvarint(br)
+			if err != nil || length > maxTraceSite {
+				return nil, truncated(err)
+			}
+			name := make([]byte, length)
+			if _, err := io.ReadFull(br, name); err != nil {
+				return nil, truncated(err)
+			}
+			sites = append(sites, string(name))
+			continue
+		}
+
+		count, ok := traceOperands[TraceOp(op)]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown record %#x", ErrInvalidTrace, op)
+		}
+
+		values := make([]uint64, 2+count)
+		for i := range values {
+			if values[i], err = binary.ReadUvarint(br); err != nil {
+				return nil, truncated(err)
+			}
+		}
+		if values[1] >= uint64(len(sites)) {
+			return nil, fmt.Errorf("%w: unknown call site %d", ErrInvalidTrace, values[1])
+		}
+
+		now += time.Duration(values[0])
+		event := TraceEvent{Op: TraceOp(op), Time: now, Site: sites[values[1]]}
+		if count > 0 {
+			event.ID = values[2]
+		}
+		if count > 1 {
+			event.Size, event.Align = int(values[3]), int(values[4])
+		}
+		events = append(events, event)
+	}
+}
+
+func truncated(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: %w", ErrInvalidTrace, err)
+}
+
+// ReplayReport summarizes a trace replayed against one allocator.
+type ReplayReport struct {
+	Name              string
+	Operations        int
+	Failed            int
+	PeakUsed          int
+	MaxFragmentation  float64
+	MeanFragmentation float64
+	Duration          time.Duration
+}
+
+// Throughput returns operations per second.
+func (r ReplayReport) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Operations) / r.Duration.Seconds()
+}
+
+// Replay runs events against a heap returned by newHeap twice: once timed,
+// without the construction of the heap, and once collecting Stats after
+// every operation, which would otherwise dominate the time.
+func Replay(events []TraceEvent, newHeap func() Heap) ReplayReport {
+	report := ReplayReport{Operations: len(events)}
+
+	heap := newHeap()
+	start := time.Now()
+	replay(events, heap, func(Heap) {})
+	report.Duration = time.Since(start)
+
+	var total float64
+	report.Failed = replay(events, newHeap(), func(heap Heap) {
+		stats := heap.Stats()
+		fragmentation := stats.Fragmentation()
+
+		report.PeakUsed = max(report.PeakUsed, stats.Used)
+		report.MaxFragmentation = max(report.MaxFragmentation, fragmentation)
+		total += fragmentation
+	})
+	if len(events) > 0 {
+		report.MeanFragmentation = total / float64(len(events))
+	}
+
+	return report
+}
+
+// replay returns the number of failed operations. Failed allocations are
+// replayed as well, so a trace of an allocator running out of memory still
+// exercises the same sizes. Frees of unknown pointers failed when they were
+// traced and are skipped, as are defragmentations of heaps that do not
+// support them.
+func replay(events []TraceEvent, heap Heap, observe func(Heap)) int {
+	live := map[uint64]unsafe.Pointer{}
+	failed := 0
+
+	for _, event := range events {
+		switch event.Op {
+		case TraceAlloc:
+			ptr, err := heap.Alloc(event.Size, event.Align)
+			switch {
+			case err != nil:
+				failed++
+			case event.ID == 0:
+				_ = heap.Free(ptr)
+			default:
+				live[event.ID] = ptr
+			}
+		case TraceFree:
+			if event.ID == 0 {
+				break
+			}
+			ptr, ok := live[event.ID]
+			if !ok || heap.Free(ptr) != nil {
+				failed++
+			}
+			delete(live, event.ID)
+		case TraceDefragment:
+			if d, ok := heap.(defragmenter); ok {
+				moved := d.Defragment()
+				for id, ptr := range live {
+					if to, ok := moved[ptr]; ok {
+						live[id] = to
+					}
+				}
+			}
+		}
+		observe(heap)
+	}
+
+	return failed
+}
+
+// Compare replays events against every allocator and returns the reports
+// sorted by name.
+func Compare(events []TraceEvent, heaps map[string]func() Heap) []ReplayReport {
+	reports := make([]ReplayReport, 0, len(heaps))
+	for name, newHeap := range heaps {
+		report := Replay(events, newHeap)
+		report.Name = name
+		reports = append(reports, report)
+	}
+
+	slices.SortFunc(reports, func(a, b ReplayReport) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return reports
+}
+
+func WriteReplayReports(w io.Writer, reports []ReplayReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "allocator\tops\tfailed\tpeak used\tmax frag\tmean frag\tops/s\t")
+	for _, r := range reports {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.2f\t%.2f\t%.0f\t\n",
+			r.Name, r.Operations, r.Failed, r.PeakUsed, r.MaxFragmentation, r.MeanFragmentation, r.Throughput())
+	}
+	return tw.Flush()
+}
+
+func traceWorkload(heap Heap, random *rand.Rand) {
+	var live []unsafe.Pointer
+	for range 500 {
+		if len(live) > 0 && random.Intn(3) == 0 {
+			j := random.Intn(len(live))
+			_ = heap.Free(live[j])
+			live = slices.Delete(live, j, j+1)
+			continue
+		}
+
+		ptr, err := heap.Alloc(8+random.Intn(500), 8)
+		if err == nil {
+			live = append(live, ptr)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	buf := bytes.Buffer{}
+	memory := alignedMemory(256)
+	tracer := NewTracer(NewAllocator(memory, FirstFit{}), &buf)
+
+	first, err := tracer.Alloc(64, 8)
+	assert.NoError(t, err)
+	second, err := tracer.Alloc(32, 16)
+	assert.NoError(t, err)
+	_, err = tracer.Alloc(1024, 8)
+	assert.ErrorIs(t, err, ErrOutOfMemory)
+	assert.NoError(t, tracer.Free(first))
+	moved := tracer.Defragment()
+	assert.ErrorIs(t, tracer.Free(second), ErrInvalidPointer)
+	assert.NoError(t, tracer.Free(moved[second]))
+	assert.NoError(t, tracer.Flush())
+
+	events, err := ReadTrace(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+
+	sites := map[string]bool{}
+	for i := range events {
+		assert.Contains(t, events[i].Site, "TestTracer trace_test.go:")
+		sites[events[i].Site] = true
+		if i > 0 {
+			assert.GreaterOrEqual(t, events[i].Time, events[i-1].Time)
+		}
+		events[i].Site, events[i].Time = "", 0
+	}
+	assert.Len(t, sites, len(events))
+
+	assert.Equal(t, []TraceEvent{
+		{Op: TraceAlloc, ID: 1, Size: 64, Align: 8},
+		{Op: TraceAlloc, ID: 2, Size: 32, Align: 16},
+		{Op: TraceAlloc, Size: 1024, Align: 8},
+		{Op: TraceFree, ID: 1},
+		{Op: TraceDefragment},
+		{Op: TraceFree},
+		{Op: TraceFree, ID: 2},
+	}, events)
+}
+
+func TestTracerWithoutDefragment(t *testing.T) {
+	buf := bytes.Buffer{}
+	tracer := NewTracer(NewBuddy(alignedMemory(256), 16), &buf)
+
+	ptr, err := tracer.Alloc(32, 8)
+	assert.NoError(t, err)
+	assert.Nil(t, tracer.Defragment())
+	assert.NoError(t, tracer.Free(ptr))
+	assert.NoError(t, tracer.Flush())
+
+	events, err := ReadTrace(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	ops := make([]TraceOp, len(events))
+	for i, event := range events {
+		ops[i] = event.Op
+	}
+	assert.Equal(t, []TraceOp{TraceAlloc, TraceDefragment, TraceFree}, ops)
+
+	// the buddy allocator cannot replay the defragmentation and skips it
+	report := Replay(events, func() Heap { return NewBuddy(alignedMemory(256), 16) })
+	assert.Zero(t, report.Failed)
+}
+
+func TestReadTraceErrors(t *testing.T) {
+	buf := bytes.Buffer{}
+	tracer := NewTracer(NewAllocator(alignedMemory(64), FirstFit{}), &buf)
+	_, _ = tracer.Alloc(8, 8)
+	assert.NoError(t, tracer.Flush())
+	trace := buf.Bytes()
+
+	tests := map[string][]byte{
+		"empty":          nil,
+		"magic":          []byte("ATRC\x02"),
+		"truncated":      trace[:len(trace)-1],
+		"unknown record": append(slices.Clone(trace), 0x7F),
+		"unknown site":   append([]byte(traceMagic), byte(TraceDefragment), 0x00, 0x05),
+		"long site": append(binary.AppendUvarint([]byte(traceMagic+"\x00"), maxTraceSite+1),
+			strings.Repeat("x", maxTraceSite+1)...),
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ReadTrace(bytes.NewReader(test))
+			assert.ErrorIs(t, err, ErrInvalidTrace)
+		})
+	}
+}
+
+func TestTraceLongSite(t *testing.T) {
+	trace := append([]byte(traceMagic), siteRecord(strings.Repeat("x", maxTraceSite+1))...)
+	trace = append(trace, byte(TraceDefragment), 0x00, 0x00)
+
+	events, err := ReadTrace(bytes.NewReader(trace))
+	assert.NoError(t, err)
+	assert.Equal(t, []TraceEvent{{Op: TraceDefragment, Site: strings.Repeat("x", maxTraceSite)}}, events)
+}
+
+func TestReplayFailedFree(t *testing.T) {
+	newHeap := func() Heap { return NewAllocator(alignedMemory(64), FirstFit{}) }
+
+	// a free that failed when traced is not replayed
+	events := []TraceEvent{{Op: TraceAlloc, ID: 1, Size: 8, Align: 8}, {Op: TraceFree}, {Op: TraceFree, ID: 1}}
+	assert.Zero(t, Replay(events, newHeap).Failed)
+
+	// a free of a block whose allocation failed during the replay fails too
+	events = []TraceEvent{{Op: TraceAlloc, ID: 1, Size: 128, Align: 8}, {Op: TraceFree, ID: 1}}
+	assert.Equal(t, 2, Replay(events, newHeap).Failed)
+}
+
+func TestReplay(t *testing.T) {
+	buf := bytes.Buffer{}
+	tracer := NewTracer(NewAllocator(alignedMemory(1<<18), FirstFit{}), &buf)
+	traceWorkload(tracer, rand.New(rand.NewSource(1)))
+	tracer.Defragment()
+	assert.NoError(t, tracer.Flush())
+
+	// call sites are written once, so records take a few bytes each
+	size := buf.Len()
+	events, err := ReadTrace(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, events, 500+1)
+	assert.Less(t, size, len(events)*12)
+
+	reports := Compare(events, map[string]func() Heap{
+		"first fit": func() Heap { return NewAllocator(alignedMemory(1<<18), FirstFit{}) },
+		"best fit":  func() Heap { return NewAllocator(alignedMemory(1<<18), BestFit{}) },
+		"buddy":     func() Heap { return NewBuddy(alignedMemory(1<<18), 16) },
+		"slab":      func() Heap { return NewSlabAllocator(alignedMemory(1 << 20)) },
+	})
+
+	names := make([]string, len(reports))
+	for i, report := range reports {
+		names[i] = report.Name
+		assert.Equal(t, len(events), report.Operations)
+		assert.Zero(t, report.Failed)
+		assert.Positive(t, report.PeakUsed)
+		assert.Positive(t, report.Throughput())
+		assert.LessOrEqual(t, report.MeanFragmentation, report.MaxFragmentation)
+	}
+	assert.Equal(t, []string{"best fit", "buddy", "first fit", "slab"}, names)
+
+	// the buddy allocator rounds sizes up to powers of two
+	assert.Greater(t, reports[1].PeakUsed, reports[2].PeakUsed)
+
+	out := strings.Builder{}
+	assert.NoError(t, WriteReplayReports(&out, reports))
+	assert.Len(t, strings.Split(strings.TrimSpace(out.String()), "\n"), 5)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v bitstream_test.go
+
+var ErrInvalidWidth = errors.New("bit width must be between 1 and 64")
+
+// BitOrder is the order in which bits fill a byte.
+type BitOrder int
+
+const (
+	// MSBFirst fills bytes from the most significant bit and writes values
+	// most significant bit first, like most network protocols and JPEG.
+	MSBFirst BitOrder = iota
+	// LSBFirst fills bytes from the least significant bit and writes values
+	// least significant bit first, like DEFLATE.
+	LSBFirst
+)
+
+// BitWriter writes values of 1 to 64 bits to an io.Writer. Bytes are
+// buffered until Flush.
+type BitWriter struct {
+	w       io.Writer
+	order   BitOrder
+	buf     []byte
+	current byte
+	used    int // bits of current already written
+	err     error
+}
+
+func NewBitWriter(w io.Writer, order BitOrder) *BitWriter {
+	return &BitWriter{w: w, order: order}
+}
+
+// WriteBits writes the low width bits of value.
+func (w *BitWriter) WriteBits(value uint64, width int) error {
+	if width < 1 || width > 64 {
+		return ErrInvalidWidth
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	for remaining := width; remaining > 0; {
+		take := min(8-w.used, remaining)
+		mask := uint64(1)<<take - 1
+
+		if w.order == MSBFirst {
+			chunk := value >> (remaining - take) & mask
+			w.current |= byte(chunk << (8 - w.used - take))
+		} else {
+			chunk := value >> (width - remaining) & mask
+			w.current |= byte(chunk << w.used)
+		}
+
+		remaining -= take
+		w.used += take
+		if w.used == 8 {
+			w.buf = append(w.buf, w.current)
+			w.current, w.used = 0, 0
+		}
+	}
+
+	if len(w.buf) >= 4096 {
+		return w.flushBuffer()
+	}
+	return nil
+}
+
+func (w *BitWriter) WriteBit(bit bool) error {
+	if bit {
+		return w.WriteBits(1, 1)
+	}
+	return w.WriteBits(0, 1)
+}
+
+// Align pads the current byte with zero bits.
+func (w *BitWriter) Align() error {
+	if w.used == 0 {
+		return w.err
+	}
+	return w.WriteBits(0, 8-w.used)
+}
+
+// Flush aligns the stream to a byte and writes all buffered bytes.
+func (w *BitWriter) Flush() error {
+	if err := w.Align(); err != nil {
+		return err
+	}
+	return w.flushBuffer()
+}
+
+func (w *BitWriter) flushBuffer() error {
+	if w.err == nil && len(w.buf) > 0 {
+		_, w.err = w.w.Write(w.buf)
+		w.buf = w.buf[:0]
+	}
+	return w.err
+}
+
+// BitReader reads values of 1 to 64 bits from an io.Reader. Readers that do
+// not implement io.ByteReader are buffered, so they may be read ahead.
+type BitReader struct {
+	r     io.ByteReader
+	order BitOrder
+	buf   []byte // bytes fetched and not fully consumed
+	used  int    // bits of buf[0] already consumed
+}
+
+func NewBitReader(r io.Reader, order BitOrder) *BitReader {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &BitReader{r: br, order: order}
+}
+
+// ReadBits reads a value of width bits. It returns io.EOF if no bits are
+// left and io.ErrUnexpectedEOF if fewer than width are.
+func (r *BitReader) ReadBits(width int) (uint64, error) {
+	value, err := r.PeekBits(width)
+	if err != nil {
+		return 0, err
+	}
+
+	r.used += width
+	r.buf = r.buf[r.used/8:]
+	r.used %= 8
+	return value, nil
+}
+
+func (r *BitReader) ReadBit() (bool, error) {
+	value, err := r.ReadBits(1)
+	return value == 1, err
+}
+
+// PeekBits returns the next width bits without consuming them.
+func (r *BitReader) PeekBits(width int) (uint64, error) {
+	if width < 1 || width > 64 {
+		return 0, ErrInvalidWidth
+	}
+
+	for len(r.buf)*8-r.used < width {
+		b, err := r.r.ReadByte()
+		if err == io.EOF && (len(r.buf) > 0 || r.used > 0) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.buf = append(r.buf, b)
+	}
+
+	var value uint64
+	offset := r.used
+	for i, remaining := 0, width; remaining > 0; i++ {
+		available := 8 - offset
+		take := min(available, remaining)
+		mask := uint64(1)<<take - 1
+
+		if r.order == MSBFirst {
+			value = value<<take | uint64(r.buf[i])>>(available-take)&mask
+		} else {
+			value |= (uint64(r.buf[i]) >> offset & mask) << (width - remaining)
+		}
+
+		remaining -= take
+		offset = 0
+	}
+	return value, nil
+}
+
+// Align discards the rest of the current byte.
+func (r *BitReader) Align() {
+	if r.used > 0 {
+		r.buf = r.buf[1:]
+		r.used = 0
+	}
+}
+
+func TestBitWriter(t *testing.T) {
+	tests := map[string]struct {
+		order    BitOrder
+		expected []byte
+	}{
+		"msb first": {
+			order:    MSBFirst,
+			expected: []byte{0b1_011_0000, 0b0000_1111, 0b1111_0010, 0b1000_0000},
+		},
+		"lsb first": {
+			order:    LSBFirst,
+			expected: []byte{0b1111_011_1, 0b0000_1111, 0b0010_0000, 0b0000_0001},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			w := NewBitWriter(&buf, test.order)
+
+			assert.NoError(t, w.WriteBit(true))
+			assert.NoError(t, w.WriteBits(0b011, 3))
+			assert.NoError(t, w.WriteBits(0x00FF, 16))
+			assert.NoError(t, w.WriteBits(0b0010, 4))
+			assert.NoError(t, w.Align())
+			assert.NoError(t, w.WriteBit(true))
+			assert.ErrorIs(t, w.WriteBits(0, 0), ErrInvalidWidth)
+			assert.ErrorIs(t, w.WriteBits(0, 65), ErrInvalidWidth)
+
+			assert.Empty(t, buf.Bytes())
+			assert.NoError(t, w.Flush())
+			assert.Equal(t, test.expected, buf.Bytes())
+		})
+	}
+}
+
+func TestBitReader(t *testing.T) {
+	tests := map[string]struct {
+		order BitOrder
+		data  []byte
+	}{
+		"msb first": {order: MSBFirst, data: []byte{0b1_011_0000, 0b0000_1111, 0b1111_0010, 0b1000_0000}},
+		"lsb first": {order: LSBFirst, data: []byte{0b1111_011_1, 0b0000_1111, 0b0010_0000, 0b0000_0001}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := NewBitReader(bytes.NewReader(test.data), test.order)
+
+			bit, err := r.ReadBit()
+			assert.NoError(t, err)
+			assert.True(t, bit)
+
+			peeked, err := r.PeekBits(3)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0b011), peeked)
+
+			for _, expected := range []struct {
+				value uint64
+				width int
+			}{{0b011, 3}, {0x00FF, 16}, {0b0010, 4}} {
+				value, err := r.ReadBits(expected.width)
+				assert.NoError(t, err)
+				assert.Equal(t, expected.value, value)
+			}
+
+			r.Align()
+			bit, err = r.ReadBit()
+			assert.NoError(t, err)
+			assert.True(t, bit)
+
+			_, err = r.ReadBits(8)
+			assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+			_, err = r.ReadBits(7)
+			assert.NoError(t, err)
+			_, err = r.ReadBits(1)
+			assert.ErrorIs(t, err, io.EOF)
+			_, err = r.PeekBits(65)
+			assert.ErrorIs(t, err, ErrInvalidWidth)
+		})
+	}
+}
+
+func TestBitStreamRoundTrip(t *testing.T) {
+	for name, order := range map[string]BitOrder{"msb first": MSBFirst, "lsb first": LSBFirst} {
+		t.Run(name, func(t *testing.T) {
+			random := rand.New(rand.NewSource(1))
+			widths := make([]int, 10000)
+			values := make([]uint64, len(widths))
+
+			// a plain io.Writer and io.Reader, beyond the internal buffer size
+			buf := bytes.Buffer{}
+			w := NewBitWriter(struct{ io.Writer }{&buf}, order)
+			for i := range widths {
+				widths[i] = 1 + random.Intn(64)
+				value := random.Uint64()
+				// bits above the width are ignored
+				values[i] = value & (^uint64(0) >> (64 - widths[i]))
+				assert.NoError(t, w.WriteBits(value, widths[i]))
+			}
+			assert.NoError(t, w.Flush())
+
+			r := NewBitReader(struct{ io.Reader }{&buf}, order)
+			for i, width := range widths {
+				value, err := r.ReadBits(width)
+				assert.NoError(t, err)
+				assert.Equal(t, values[i], value)
+			}
+		})
+	}
+}
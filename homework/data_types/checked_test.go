@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v checked_test.go
+
+var ErrIntegerOverflow = errors.New("integer overflow")
+
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+func isSigned[T Integer]() bool {
+	return ^T(0) < 0
+}
+
+// limits returns the smallest and the largest value of T.
+func limits[T Integer]() (lowest, highest T) {
+	if !isSigned[T]() {
+		return 0, ^T(0)
+	}
+	lowest = T(1) << (unsafe.Sizeof(lowest)*8 - 1)
+	return lowest, lowest - 1
+}
+
+// AddChecked returns a + b, or ErrIntegerOverflow if it does not fit T.
+func AddChecked[T Integer](a, b T) (T, error) {
+	sum := a + b
+	if isSigned[T]() && (sum > a) != (b > 0) || !isSigned[T]() && sum < a {
+		return 0, ErrIntegerOverflow
+	}
+	return sum, nil
+}
+
+func SubChecked[T Integer](a, b T) (T, error) {
+	difference := a - b
+	if isSigned[T]() && (difference < a) != (b > 0) || !isSigned[T]() && a < b {
+		return 0, ErrIntegerOverflow
+	}
+	return difference, nil
+}
+
+func MulChecked[T Integer](a, b T) (T, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+
+	product := a * b
+	if isSigned[T]() {
+		// ^T(0) is -1, and lowest / -1 wraps back to lowest, so the
+		// division below does not notice
+		lowest, _ := limits[T]()
+		if a == ^T(0) && b == lowest || b == ^T(0) && a == lowest {
+			return 0, ErrIntegerOverflow
+		}
+	}
+	if product/b != a {
+		return 0, ErrIntegerOverflow
+	}
+	return product, nil
+}
+
+// ConvertChecked converts value to another integer type, or returns
+// ErrIntegerOverflow if it does not fit.
+func ConvertChecked[To, From Integer](value From) (To, error) {
+	converted := To(value)
+	if From(converted) != value || (converted < 0) != (value < 0) {
+		return 0, ErrIntegerOverflow
+	}
+	return converted, nil
+}
+
+// AddSaturating returns a + b, clamped to the range of T.
+func AddSaturating[T Integer](a, b T) T {
+	sum, err := AddChecked(a, b)
+	if err == nil {
+		return sum
+	}
+	lowest, highest := limits[T]()
+	if b < 0 {
+		return lowest
+	}
+	return highest
+}
+
+func SubSaturating[T Integer](a, b T) T {
+	difference, err := SubChecked(a, b)
+	if err == nil {
+		return difference
+	}
+	lowest, highest := limits[T]()
+	if isSigned[T]() && b < 0 {
+		return highest
+	}
+	return lowest
+}
+
+func MulSaturating[T Integer](a, b T) T {
+	product, err := MulChecked(a, b)
+	if err == nil {
+		return product
+	}
+	lowest, highest := limits[T]()
+	if (a < 0) != (b < 0) {
+		return lowest
+	}
+	return highest
+}
+
+// ConvertSaturating converts value to another integer type, clamped to its
+// range.
+func ConvertSaturating[To, From Integer](value From) To {
+	converted, err := ConvertChecked[To](value)
+	if err == nil {
+		return converted
+	}
+	lowest, highest := limits[To]()
+	if value < 0 {
+		return lowest
+	}
+	return highest
+}
+
+func TestChecked(t *testing.T) {
+	tests := map[string]struct {
+		operation func() (int64, error)
+		expected  int64
+		err       error
+	}{
+		"add":                {operation: func() (int64, error) { return AddChecked[int64](40, 2) }, expected: 42},
+		"add overflow":       {operation: func() (int64, error) { return AddChecked[int64](math.MaxInt64, 1) }, err: ErrIntegerOverflow},
+		"add underflow":      {operation: func() (int64, error) { return AddChecked[int64](math.MinInt64, -1) }, err: ErrIntegerOverflow},
+		"add to lowest":      {operation: func() (int64, error) { return AddChecked[int64](-1, math.MinInt64+1) }, expected: math.MinInt64},
+		"sub":                {operation: func() (int64, error) { return SubChecked[int64](-40, 2) }, expected: -42},
+		"sub overflow":       {operation: func() (int64, error) { return SubChecked[int64](0, math.MinInt64) }, err: ErrIntegerOverflow},
+		"sub underflow":      {operation: func() (int64, error) { return SubChecked[int64](math.MinInt64, 1) }, err: ErrIntegerOverflow},
+		"mul":                {operation: func() (int64, error) { return MulChecked[int64](-6, 7) }, expected: -42},
+		"mul overflow":       {operation: func() (int64, error) { return MulChecked[int64](1<<32, 1<<31) }, err: ErrIntegerOverflow},
+		"mul to lowest":      {operation: func() (int64, error) { return MulChecked[int64](-1<<32, 1<<31) }, expected: math.MinInt64},
+		"mul lowest by -1":   {operation: func() (int64, error) { return MulChecked[int64](math.MinInt64, -1) }, err: ErrIntegerOverflow},
+		"mul -1 by lowest":   {operation: func() (int64, error) { return MulChecked[int64](-1, math.MinInt64) }, err: ErrIntegerOverflow},
+		"convert":            {operation: func() (int64, error) { v, err := ConvertChecked[int32](int64(-1 << 31)); return int64(v), err }, expected: -1 << 31},
+		"convert overflow":   {operation: func() (int64, error) { v, err := ConvertChecked[int32](int64(1 << 31)); return int64(v), err }, err: ErrIntegerOverflow},
+		"convert to uint":    {operation: func() (int64, error) { v, err := ConvertChecked[uint8](int64(-1)); return int64(v), err }, err: ErrIntegerOverflow},
+		"convert from uint":  {operation: func() (int64, error) { v, err := ConvertChecked[int64](uint64(math.MaxUint64)); return v, err }, err: ErrIntegerOverflow},
+		"convert same width": {operation: func() (int64, error) { v, err := ConvertChecked[uint32](int32(math.MaxInt32)); return int64(v), err }, expected: math.MaxInt32},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := test.operation()
+			assert.ErrorIs(t, err, test.err)
+			assert.Equal(t, test.expected, result)
+		})
+	}
+}
+
+func TestSaturating(t *testing.T) {
+	assert.Equal(t, int8(math.MaxInt8), AddSaturating[int8](100, 100))
+	assert.Equal(t, int8(math.MinInt8), AddSaturating[int8](-100, -100))
+	assert.Equal(t, uint8(math.MaxUint8), AddSaturating[uint8](200, 100))
+	assert.Equal(t, int8(math.MaxInt8), SubSaturating[int8](100, -100))
+	assert.Equal(t, int8(math.MinInt8), SubSaturating[int8](-100, 100))
+	assert.Equal(t, uint8(0), SubSaturating[uint8](1, 2))
+	assert.Equal(t, int16(math.MinInt16), MulSaturating[int16](-300, 300))
+	assert.Equal(t, int16(math.MaxInt16), MulSaturating[int16](-300, -300))
+	assert.Equal(t, uint16(math.MaxUint16), MulSaturating[uint16](300, 300))
+	assert.Equal(t, int32(math.MaxInt32), ConvertSaturating[int32](int64(math.MaxInt64)))
+	assert.Equal(t, int32(math.MinInt32), ConvertSaturating[int32](int64(math.MinInt64)))
+	assert.Equal(t, uint32(0), ConvertSaturating[uint32](-5))
+	assert.Equal(t, int64(math.MaxInt64), ConvertSaturating[int64](uint64(math.MaxUint64)))
+	assert.Equal(t, 42, ConvertSaturating[int](uint8(42)))
+}
+
+// TestCheckedExhaustive compares every pair of 8-bit values with int
+// arithmetic, which cannot overflow.
+func TestCheckedExhaustive(t *testing.T) {
+	for a := math.MinInt8; a <= math.MaxInt8; a++ {
+		for b := math.MinInt8; b <= math.MaxInt8; b++ {
+			checkExhaustive(t, int8(a), int8(b), a+b, AddChecked[int8], AddSaturating[int8])
+			checkExhaustive(t, int8(a), int8(b), a-b, SubChecked[int8], SubSaturating[int8])
+			checkExhaustive(t, int8(a), int8(b), a*b, MulChecked[int8], MulSaturating[int8])
+		}
+	}
+
+	for a := range math.MaxUint8 + 1 {
+		for b := range math.MaxUint8 + 1 {
+			checkExhaustive(t, uint8(a), uint8(b), a+b, AddChecked[uint8], AddSaturating[uint8])
+			checkExhaustive(t, uint8(a), uint8(b), a-b, SubChecked[uint8], SubSaturating[uint8])
+			checkExhaustive(t, uint8(a), uint8(b), a*b, MulChecked[uint8], MulSaturating[uint8])
+		}
+	}
+}
+
+func checkExhaustive[T int8 | uint8](t *testing.T, a, b T, expected int, checked func(T, T) (T, error), saturating func(T, T) T) {
+	lowest, highest := limits[T]()
+	fits := expected >= int(lowest) && expected <= int(highest)
+
+	result, err := checked(a, b)
+	if fits != (err == nil) || fits && int(result) != expected {
+		t.Fatalf("checked %d, %d: got %d, %v, expected %d", a, b, result, err, expected)
+	}
+
+	clamped := min(max(expected, int(lowest)), int(highest))
+	if int(saturating(a, b)) != clamped {
+		t.Fatalf("saturating %d, %d: got %d, expected %d", a, b, saturating(a, b), clamped)
+	}
+}
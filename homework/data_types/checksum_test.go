@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"hash/crc64"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v checksum_test.go
+
+// Reversed CRC polynomials, as in hash/crc32 and hash/crc64.
+const (
+	CRC32IEEE       = 0xEDB88320
+	CRC32Castagnoli = 0x82F63B78
+	CRC64ISO        = 0xD800000000000000
+	CRC64ECMA       = 0xC96C5795D7870F42
+)
+
+// crcTable holds the CRC of every byte followed by 0 to 7 zero bytes, the
+// first row is the classic byte-at-a-time table.
+type crcTable[T uint32 | uint64] [8][256]T
+
+func makeCRCTable[T uint32 | uint64](poly T) *crcTable[T] {
+	table := new(crcTable[T])
+	for i := range 256 {
+		crc := T(i)
+		for range 8 {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[0][i] = crc
+	}
+
+	for i := range 256 {
+		crc := table[0][i]
+		for j := 1; j < 8; j++ {
+			crc = table[0][byte(crc)] ^ crc>>8
+			table[j][i] = crc
+		}
+	}
+	return table
+}
+
+// crcTables caches tables by crcKey.
+var crcTables sync.Map
+
+type crcKey struct {
+	size int
+	poly uint64
+}
+
+// cachedCRCTable builds the table of a polynomial once.
+func cachedCRCTable[T uint32 | uint64](poly T) *crcTable[T] {
+	key := crcKey{size: int(unsafe.Sizeof(poly)), poly: uint64(poly)}
+	if table, ok := crcTables.Load(key); ok {
+		return table.(*crcTable[T])
+	}
+	table, _ := crcTables.LoadOrStore(key, makeCRCTable(poly))
+	return table.(*crcTable[T])
+}
+
+// update continues crc over data one byte at a time.
+func (t *crcTable[T]) update(crc T, data []byte) T {
+	crc = ^crc
+	for _, b := range data {
+		crc = t[0][byte(crc)^b] ^ crc>>8
+	}
+	return ^crc
+}
+
+// updateSlicing8 continues crc over data eight bytes at a time: the CRC
+// register is folded into the next word, and each of its bytes is looked
+// up in the row of the bytes still following it.
+func (t *crcTable[T]) updateSlicing8(crc T, data []byte) T {
+	crc = ^crc
+	for ; len(data) >= 8; data = data[8:] {
+		// a 32-bit register only covers the first four bytes
+		x := binary.LittleEndian.Uint64(data) ^ uint64(crc)
+		crc = t[7][byte(x)] ^ t[6][byte(x>>8)] ^ t[5][byte(x>>16)] ^ t[4][byte(x>>24)] ^
+			t[3][byte(x>>32)] ^ t[2][byte(x>>40)] ^ t[1][byte(x>>48)] ^ t[0][byte(x>>56)]
+	}
+	for _, b := range data {
+		crc = t[0][byte(crc)^b] ^ crc>>8
+	}
+	return ^crc
+}
+
+const (
+	adlerModulus = 65521
+	// adlerBlock is the most bytes summed before the sums can overflow 32 bits
+	adlerBlock = 5552
+)
+
+func updateAdler32(adler uint32, data []byte) uint32 {
+	a, b := adler&0xFFFF, adler>>16
+	for len(data) > 0 {
+		n := min(len(data), adlerBlock)
+		for _, c := range data[:n] {
+			a += uint32(c)
+			b += a
+		}
+		a %= adlerModulus
+		b %= adlerModulus
+		data = data[n:]
+	}
+	return b<<16 | a
+}
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+func updateFNV1a32(h uint32, data []byte) uint32 {
+	for _, c := range data {
+		h = (h ^ uint32(c)) * fnvPrime32
+	}
+	return h
+}
+
+func updateFNV1a64(h uint64, data []byte) uint64 {
+	for _, c := range data {
+		h = (h ^ uint64(c)) * fnvPrime64
+	}
+	return h
+}
+
+func CRC32(poly uint32, data []byte) uint32 {
+	return cachedCRCTable(poly).updateSlicing8(0, data)
+}
+
+func CRC64(poly uint64, data []byte) uint64 {
+	return cachedCRCTable(poly).updateSlicing8(0, data)
+}
+
+func Adler32(data []byte) uint32 {
+	return updateAdler32(1, data)
+}
+
+func FNV1a32(data []byte) uint32 {
+	return updateFNV1a32(fnvOffset32, data)
+}
+
+func FNV1a64(data []byte) uint64 {
+	return updateFNV1a64(fnvOffset64, data)
+}
+
+// checksum is a streaming hash.Hash over an update function. The sum is
+// appended big-endian, as the standard library does.
+type checksum[T uint32 | uint64] struct {
+	initial T
+	sum     T
+	update  func(T, []byte) T
+}
+
+func (c *checksum[T]) Write(p []byte) (int, error) {
+	c.sum = c.update(c.sum, p)
+	return len(p), nil
+}
+
+func (c *checksum[T]) Sum(b []byte) []byte {
+	if c.Size() == 4 {
+		return binary.BigEndian.AppendUint32(b, uint32(c.sum))
+	}
+	return binary.BigEndian.AppendUint64(b, uint64(c.sum))
+}
+
+func (c *checksum[T]) Reset() {
+	c.sum = c.initial
+}
+
+func (c *checksum[T]) Size() int {
+	return int(unsafe.Sizeof(c.sum))
+}
+
+func (c *checksum[T]) BlockSize() int {
+	return 1
+}
+
+type checksum32 struct {
+	checksum[uint32]
+}
+
+func (c *checksum32) Sum32() uint32 {
+	return c.sum
+}
+
+type checksum64 struct {
+	checksum[uint64]
+}
+
+func (c *checksum64) Sum64() uint64 {
+	return c.sum
+}
+
+func NewCRC32(poly uint32) hash.Hash32 {
+	return &checksum32{checksum[uint32]{update: cachedCRCTable(poly).updateSlicing8}}
+}
+
+func NewCRC64(poly uint64) hash.Hash64 {
+	return &checksum64{checksum[uint64]{update: cachedCRCTable(poly).updateSlicing8}}
+}
+
+func NewAdler32() hash.Hash32 {
+	return &checksum32{checksum[uint32]{initial: 1, sum: 1, update: updateAdler32}}
+}
+
+func NewFNV1a32() hash.Hash32 {
+	return &checksum32{checksum[uint32]{initial: fnvOffset32, sum: fnvOffset32, update: updateFNV1a32}}
+}
+
+func NewFNV1a64() hash.Hash64 {
+	return &checksum64{checksum[uint64]{initial: fnvOffset64, sum: fnvOffset64, update: updateFNV1a64}}
+}
+
+func TestChecksumCheckValues(t *testing.T) {
+	check := []byte("123456789")
+
+	assert.Equal(t, uint32(0xCBF43926), CRC32(CRC32IEEE, check))
+	assert.Equal(t, uint32(0xE3069283), CRC32(CRC32Castagnoli, check))
+	assert.Equal(t, uint64(0x995DC9BBDF1939FA), CRC64(CRC64ECMA, check))
+	assert.Equal(t, uint32(0x11E60398), Adler32([]byte("Wikipedia")))
+	assert.Equal(t, uint32(0x811C9DC5), FNV1a32(nil))
+	assert.Equal(t, uint32(0xE40C292C), FNV1a32([]byte("a")))
+	assert.Equal(t, uint64(0xAF63DC4C8601EC8C), FNV1a64([]byte("a")))
+}
+
+func TestChecksumStandardLibrary(t *testing.T) {
+	crc32Tables := map[uint32]*crc32.Table{
+		CRC32IEEE:       crc32.IEEETable,
+		CRC32Castagnoli: crc32.MakeTable(crc32.Castagnoli),
+	}
+	crc64Tables := map[uint64]*crc64.Table{
+		CRC64ISO:  crc64.MakeTable(crc64.ISO),
+		CRC64ECMA: crc64.MakeTable(crc64.ECMA),
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for _, length := range []int{0, 1, 7, 8, 9, 63, 1000, adlerBlock + 1, 3 * adlerBlock} {
+		t.Run(fmt.Sprint(length), func(t *testing.T) {
+			data := make([]byte, length)
+			random.Read(data)
+			// all ones, so the Adler-32 sums grow as fast as they can
+			ones := make([]byte, length)
+			for i := range ones {
+				ones[i] = 0xFF
+			}
+
+			for poly, table := range crc32Tables {
+				ours := cachedCRCTable(poly)
+				expected := crc32.Checksum(data, table)
+				assert.Equal(t, expected, ours.update(0, data))
+				assert.Equal(t, expected, ours.updateSlicing8(0, data))
+			}
+			for poly, table := range crc64Tables {
+				ours := cachedCRCTable(poly)
+				expected := crc64.Checksum(data, table)
+				assert.Equal(t, expected, ours.update(0, data))
+				assert.Equal(t, expected, ours.updateSlicing8(0, data))
+			}
+
+			assert.Equal(t, adler32.Checksum(data), Adler32(data))
+			assert.Equal(t, adler32.Checksum(ones), Adler32(ones))
+
+			fnv32 := fnv.New32a()
+			fnv32.Write(data)
+			assert.Equal(t, fnv32.Sum32(), FNV1a32(data))
+			fnv64 := fnv.New64a()
+			fnv64.Write(data)
+			assert.Equal(t, fnv64.Sum64(), FNV1a64(data))
+		})
+	}
+}
+
+func TestChecksumHash(t *testing.T) {
+	tests := map[string]struct {
+		ours     hash.Hash
+		standard hash.Hash
+	}{
+		"crc32 ieee":       {ours: NewCRC32(CRC32IEEE), standard: crc32.NewIEEE()},
+		"crc32 castagnoli": {ours: NewCRC32(CRC32Castagnoli), standard: crc32.New(crc32.MakeTable(crc32.Castagnoli))},
+		"crc64 ecma":       {ours: NewCRC64(CRC64ECMA), standard: crc64.New(crc64.MakeTable(crc64.ECMA))},
+		"adler32":          {ours: NewAdler32(), standard: adler32.New()},
+		"fnv1a32":          {ours: NewFNV1a32(), standard: fnv.New32a()},
+		"fnv1a64":          {ours: NewFNV1a64(), standard: fnv.New64a()},
+	}
+
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.standard.Size(), test.ours.Size())
+			assert.Equal(t, test.standard.Sum(nil), test.ours.Sum(nil))
+
+			// written in uneven chunks
+			for chunk, rest := 1, data; len(rest) > 0; chunk = chunk*3 + 1 {
+				n := min(chunk, len(rest))
+				test.ours.Write(rest[:n])
+				rest = rest[n:]
+			}
+			test.standard.Write(data)
+			assert.Equal(t, test.standard.Sum([]byte("prefix")), test.ours.Sum([]byte("prefix")))
+
+			test.ours.Reset()
+			test.standard.Reset()
+			test.ours.Write(data[:100])
+			test.standard.Write(data[:100])
+			assert.Equal(t, test.standard.Sum(nil), test.ours.Sum(nil))
+		})
+	}
+
+	h := NewCRC32(CRC32IEEE)
+	h.Write([]byte("123456789"))
+	assert.Equal(t, uint32(0xCBF43926), h.Sum32())
+}
+
+func BenchmarkCRC32(b *testing.B) {
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	table := cachedCRCTable(uint32(CRC32Castagnoli))
+	standardTable := crc32.MakeTable(crc32.Castagnoli)
+
+	benchmarks := map[string]func() uint32{
+		"table":     func() uint32 { return table.update(0, data) },
+		"slicing-8": func() uint32 { return table.updateSlicing8(0, data) },
+		// hash/crc32 uses the SSE4.2 or ARMv8 CRC instructions when it can
+		"hash/crc32": func() uint32 { return crc32.Checksum(data, standardTable) },
+	}
+
+	for name, checksum := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				checksum()
+			}
+		})
+	}
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	ecma := crc64.MakeTable(crc64.ECMA)
+
+	benchmarks := map[string]func(){
+		"crc64 slicing-8": func() { CRC64(CRC64ECMA, data) },
+		"hash/crc64":      func() { crc64.Checksum(data, ecma) },
+		"adler32":         func() { Adler32(data) },
+		"hash/adler32":    func() { adler32.Checksum(data) },
+		"fnv1a64":         func() { FNV1a64(data) },
+	}
+
+	for name, checksum := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				checksum()
+			}
+		})
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v codec_test.go
+
+var (
+	ErrUnsupportedType = errors.New("unsupported type")
+	ErrInvalidTag      = errors.New("invalid bin tag")
+)
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// fieldOptions is a parsed bin tag. The tag is a comma separated list of
+//
+//	le, be   byte order of the field, nested structs inherit it
+//	pad=N    N zero bytes before the field
+//	align=N  zero bytes before the field up to a multiple of N, counted from
+//	         the start of the encoding, also in nested structs
+//	-        the field is not encoded
+type fieldOptions struct {
+	order byteOrder
+	pad   int
+	align int
+	skip  bool
+}
+
+func parseTag(field reflect.StructField, order byteOrder) (fieldOptions, error) {
+	options := fieldOptions{order: order, align: 1}
+
+	tag, ok := field.Tag.Lookup("bin")
+	if !ok || tag == "" {
+		return options, nil
+	}
+
+	for _, part := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		number, err := strconv.Atoi(value)
+
+		switch {
+		case key == "-" && value == "":
+			options.skip = true
+		case key == "le" && value == "":
+			options.order = binary.LittleEndian
+		case key == "be" && value == "":
+			options.order = binary.BigEndian
+		case key == "pad" && err == nil && number >= 0:
+			options.pad = number
+		case key == "align" && err == nil && number > 0 && number&(number-1) == 0:
+			options.align = number
+		default:
+			return options, fmt.Errorf("%w: %q on field %s", ErrInvalidTag, part, field.Name)
+		}
+	}
+
+	return options, nil
+}
+
+// padding returns the bytes to insert before a field at position.
+func (o fieldOptions) padding(position int) int {
+	start := position + o.pad
+	aligned := (start + o.align - 1) &^ (o.align - 1)
+	return aligned - position
+}
+
+// Encode writes the fields of a struct, or a pointer to one, in declaration
+// order with fixed widths. Fields are little endian unless tagged otherwise,
+// blank fields are written as zero bytes.
+func Encode(v any) ([]byte, error) {
+	value, err := structValue(v, false)
+	if err != nil {
+		return nil, err
+	}
+	return encodeStruct(nil, value, binary.LittleEndian)
+}
+
+// Decode reads data written by Encode into the struct pointed to by v.
+func Decode(data []byte, v any) error {
+	value, err := structValue(v, true)
+	if err != nil {
+		return err
+	}
+
+	d := decoder{data: data}
+	return d.decodeStruct(value, binary.LittleEndian)
+}
+
+// EncodedSize returns the length of the encoding of a struct.
+func EncodedSize(v any) (int, error) {
+	data, err := Encode(v)
+	return len(data), err
+}
+
+func structValue(v any, settable bool) (reflect.Value, error) {
+	value := reflect.ValueOf(v)
+	if value.Kind() == reflect.Pointer && !value.IsNil() {
+		value = value.Elem()
+	} else if settable {
+		return reflect.Value{}, fmt.Errorf("%w: %T, expected a pointer to a struct", ErrUnsupportedType, v)
+	}
+
+	if value.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("%w: %T, expected a struct", ErrUnsupportedType, v)
+	}
+	return value, nil
+}
+
+func encodeStruct(buf []byte, v reflect.Value, order byteOrder) ([]byte, error) {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		options, err := parseTag(field, order)
+		if err != nil {
+			return nil, err
+		}
+		if options.skip {
+			continue
+		}
+
+		buf = append(buf, make([]byte, options.padding(len(buf)))...)
+		switch {
+		case field.Name == "_":
+			size, err := fixedSize(field.Type)
+			if err != nil {
+				return nil, err
+			}
+			buf = append(buf, make([]byte, size)...)
+		case !field.IsExported():
+			return nil, fmt.Errorf("%w: unexported field %s", ErrUnsupportedType, field.Name)
+		default:
+			if buf, err = encodeValue(buf, v.Field(i), options.order); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+func encodeValue(buf []byte, v reflect.Value, order byteOrder) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case reflect.Int8, reflect.Uint8:
+		return append(buf, byte(integer(v))), nil
+	case reflect.Int16, reflect.Uint16:
+		return order.AppendUint16(buf, uint16(integer(v))), nil
+	case reflect.Int32, reflect.Uint32:
+		return order.AppendUint32(buf, uint32(integer(v))), nil
+	case reflect.Int64, reflect.Uint64:
+		return order.AppendUint64(buf, integer(v)), nil
+	case reflect.Float32:
+		return order.AppendUint32(buf, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return order.AppendUint64(buf, math.Float64bits(v.Float())), nil
+	case reflect.Array:
+		var err error
+		for i := range v.Len() {
+			if buf, err = encodeValue(buf, v.Index(i), order); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Struct:
+		return encodeStruct(buf, v, order)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, v.Type())
+	}
+}
+
+// integer returns the bits of a signed or unsigned integer value.
+func integer(v reflect.Value) uint64 {
+	if v.CanInt() {
+		return uint64(v.Int())
+	}
+	return v.Uint()
+}
+
+// fixedSize returns the encoded size of a blank field.
+func fixedSize(t reflect.Type) (int, error) {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16, reflect.Int32,
+		reflect.Uint32, reflect.Int64, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return int(t.Size()), nil
+	case reflect.Array:
+		size, err := fixedSize(t.Elem())
+		return size * t.Len(), err
+	default:
+		return 0, fmt.Errorf("%w: blank field of type %s", ErrUnsupportedType, t)
+	}
+}
+
+type decoder struct {
+	data   []byte
+	offset int
+}
+
+// next returns the following n bytes of data.
+func (d *decoder) next(n int) ([]byte, error) {
+	if d.offset+n > len(d.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.data[d.offset : d.offset+n]
+	d.offset += n
+	return b, nil
+}
+
+func (d *decoder) decodeStruct(v reflect.Value, order byteOrder) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		options, err := parseTag(field, order)
+		if err != nil {
+			return err
+		}
+		if options.skip {
+			continue
+		}
+
+		if _, err := d.next(options.padding(d.offset)); err != nil {
+			return err
+		}
+		switch {
+		case field.Name == "_":
+			size, err := fixedSize(field.Type)
+			if err != nil {
+				return err
+			}
+			if _, err := d.next(size); err != nil {
+				return err
+			}
+		case !field.IsExported():
+			return fmt.Errorf("%w: unexported field %s", ErrUnsupportedType, field.Name)
+		default:
+			if err := d.decodeValue(v.Field(i), options.order); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *decoder) decodeValue(v reflect.Value, order byteOrder) error {
+	switch v.Kind() {
+	case reflect.Array:
+		for i := range v.Len() {
+			if err := d.decodeValue(v.Index(i), order); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		return d.decodeStruct(v, order)
+	case reflect.Bool, reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16, reflect.Int32,
+		reflect.Uint32, reflect.Int64, reflect.Uint64, reflect.Float32, reflect.Float64:
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedType, v.Type())
+	}
+
+	b, err := d.next(int(v.Type().Size()))
+	if err != nil {
+		return err
+	}
+
+	var bits uint64
+	switch len(b) {
+	case 1:
+		bits = uint64(b[0])
+	case 2:
+		bits = uint64(order.Uint16(b))
+	case 4:
+		bits = uint64(order.Uint32(b))
+	case 8:
+		bits = order.Uint64(b)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(bits != 0)
+	case reflect.Int8:
+		v.SetInt(int64(int8(bits)))
+	case reflect.Int16:
+		v.SetInt(int64(int16(bits)))
+	case reflect.Int32:
+		v.SetInt(int64(int32(bits)))
+	case reflect.Int64:
+		v.SetInt(int64(bits))
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(uint32(bits))))
+	case reflect.Float64:
+		v.SetFloat(math.Float64frombits(bits))
+	default:
+		v.SetUint(bits)
+	}
+	return nil
+}
+
+type legacyVersion struct {
+	Major uint8
+	Minor uint16
+}
+
+type legacyHeader struct {
+	Magic    [4]byte
+	Length   uint32        `bin:"be"`
+	Flags    uint16        `bin:"le"`
+	Version  legacyVersion `bin:"be"`
+	Checksum uint32        `bin:"align=4"`
+	Offset   int16         `bin:"be,pad=2"`
+	_        [2]byte
+	Scale    float32 `bin:"be"`
+	Points   [2]legacyPoint
+	Cached   string `bin:"-"`
+}
+
+type legacyPoint struct {
+	X int8
+	Y int16 `bin:"be"`
+}
+
+func TestEncode(t *testing.T) {
+	header := legacyHeader{
+		Magic:    [4]byte{'L', 'G', 'C', 'Y'},
+		Length:   0x01020304,
+		Flags:    0x0506,
+		Version:  legacyVersion{Major: 7, Minor: 0x0809},
+		Checksum: 0x0A0B0C0D,
+		Offset:   -2,
+		Scale:    1.5,
+		Points:   [2]legacyPoint{{X: -1, Y: 0x0102}, {X: 3, Y: -4}},
+		Cached:   "ignored",
+	}
+
+	expected := []byte{
+		'L', 'G', 'C', 'Y',
+		0x01, 0x02, 0x03, 0x04, // big endian
+		0x06, 0x05, // little endian
+		0x07, 0x08, 0x09, // nested struct inherits big endian
+		0x00, 0x00, 0x00, // aligned to 4
+		0x0D, 0x0C, 0x0B, 0x0A, // little endian by default
+		0x00, 0x00, // pad=2
+		0xFF, 0xFE,
+		0x00, 0x00, // blank field
+		0x3F, 0xC0, 0x00, 0x00,
+		0xFF, 0x01, 0x02,
+		0x03, 0xFF, 0xFC,
+	}
+
+	data, err := Encode(header)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, data)
+
+	size, err := EncodedSize(&header)
+	assert.NoError(t, err)
+	assert.Equal(t, len(expected), size)
+
+	var decoded legacyHeader
+	assert.NoError(t, Decode(data, &decoded))
+	header.Cached = ""
+	assert.Equal(t, header, decoded)
+}
+
+func TestEncodeNestedAlign(t *testing.T) {
+	type inner struct {
+		A uint8
+		B uint32 `bin:"align=4"`
+	}
+	type outer struct {
+		Tag   uint8
+		Inner inner
+	}
+
+	value := outer{Tag: 1, Inner: inner{A: 2, B: 3}}
+	data, err := Encode(value)
+	assert.NoError(t, err)
+
+	// B is aligned within the whole encoding, not within inner
+	assert.Equal(t, []byte{0x01, 0x02, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00}, data)
+
+	var decoded outer
+	assert.NoError(t, Decode(data, &decoded))
+	assert.Equal(t, value, decoded)
+}
+
+func TestEncodeTypes(t *testing.T) {
+	type values struct {
+		Bool    bool
+		Int8    int8
+		Uint8   uint8
+		Int32   int32 `bin:"be"`
+		Uint64  uint64
+		Float64 float64 `bin:"be"`
+		Matrix  [2][2]uint16
+	}
+
+	value := values{
+		Bool:    true,
+		Int8:    math.MinInt8,
+		Uint8:   math.MaxUint8,
+		Int32:   math.MinInt32,
+		Uint64:  math.MaxUint64,
+		Float64: math.Inf(-1),
+		Matrix:  [2][2]uint16{{1, 2}, {3, 4}},
+	}
+
+	data, err := Encode(&value)
+	assert.NoError(t, err)
+	assert.Len(t, data, 1+1+1+4+8+8+8)
+
+	var decoded values
+	assert.NoError(t, Decode(data, &decoded))
+	assert.Equal(t, value, decoded)
+}
+
+func TestCodecErrors(t *testing.T) {
+	type slice struct{ Values []int32 }
+	type unexported struct{ value int32 }
+	type tag struct {
+		Value int32 `bin:"align=3"`
+	}
+	type unknown struct {
+		Value int32 `bin:"middle"`
+	}
+	type integer struct{ Value int }
+
+	tests := map[string]struct {
+		value    any
+		expected error
+	}{
+		"not a struct":     {value: 42, expected: ErrUnsupportedType},
+		"slice":            {value: slice{}, expected: ErrUnsupportedType},
+		"unexported field": {value: unexported{}, expected: ErrUnsupportedType},
+		"platform integer": {value: integer{}, expected: ErrUnsupportedType},
+		"invalid align":    {value: tag{}, expected: ErrInvalidTag},
+		"unknown option":   {value: unknown{}, expected: ErrInvalidTag},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Encode(test.value)
+			assert.ErrorIs(t, err, test.expected)
+		})
+	}
+
+	var point legacyPoint
+	assert.ErrorIs(t, Decode([]byte{0x01, 0x02}, &point), io.ErrUnexpectedEOF)
+	assert.ErrorIs(t, Decode([]byte{0x01, 0x02, 0x03}, point), ErrUnsupportedType)
+}
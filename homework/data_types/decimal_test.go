@@ -0,0 +1,458 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v decimal_test.go
+
+var (
+	ErrInvalidDecimal  = errors.New("invalid decimal")
+	ErrDecimalOverflow = errors.New("decimal overflows 64 bits")
+	ErrDivisionByZero  = errors.New("division by zero")
+)
+
+// MaxScale is the largest number of fractional digits of a Decimal.
+const MaxScale = 18
+
+var pow10 = func() (table [MaxScale + 1]uint64) {
+	table[0] = 1
+	for i := 1; i < len(table); i++ {
+		table[i] = table[i-1] * 10
+	}
+	return table
+}()
+
+type RoundingMode int
+
+const (
+	RoundHalfEven RoundingMode = iota // to nearest, ties to even
+	RoundHalfUp                       // to nearest, ties away from zero
+	RoundDown                         // toward zero
+	RoundUp                           // away from zero
+	RoundFloor                        // toward negative infinity
+	RoundCeiling                      // toward positive infinity
+)
+
+// Decimal is the exact number value * 10^-scale. Arithmetic is done on
+// 128-bit intermediates and fails with ErrDecimalOverflow instead of losing
+// digits. The zero value is 0.
+type Decimal struct {
+	value int64
+	scale int
+}
+
+func NewDecimal(value int64, scale int) Decimal {
+	if scale < 0 || scale > MaxScale {
+		panic("decimal scale out of range")
+	}
+	return Decimal{value: value, scale: scale}
+}
+
+// ParseDecimal parses a number like "-12.340", keeping its fractional digits
+// as the scale.
+func ParseDecimal(s string) (Decimal, error) {
+	text := s
+	negative := strings.HasPrefix(text, "-")
+	if negative || strings.HasPrefix(text, "+") {
+		text = text[1:]
+	}
+
+	integer, fraction, _ := strings.Cut(text, ".")
+	digits := integer + fraction
+	if digits == "" || len(fraction) > MaxScale || strings.ContainsFunc(digits, func(r rune) bool {
+		return r < '0' || r > '9'
+	}) {
+		return Decimal{}, fmt.Errorf("%w: %q", ErrInvalidDecimal, s)
+	}
+
+	magnitude, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return Decimal{}, fmt.Errorf("%w: %q", ErrDecimalOverflow, s)
+	}
+	value, err := signed(magnitude, negative)
+	if err != nil {
+		return Decimal{}, fmt.Errorf("%w: %q", err, s)
+	}
+	return Decimal{value: value, scale: len(fraction)}, nil
+}
+
+func (d Decimal) String() string {
+	digits := strconv.FormatUint(abs(d.value), 10)
+	if len(digits) <= d.scale {
+		digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+	}
+
+	point := len(digits) - d.scale
+	result := digits[:point]
+	if d.scale > 0 {
+		result += "." + digits[point:]
+	}
+	if d.value < 0 {
+		result = "-" + result
+	}
+	return result
+}
+
+func (d Decimal) Scale() int {
+	return d.scale
+}
+
+func (d Decimal) Sign() int {
+	return cmp.Compare(d.value, 0)
+}
+
+// Cmp compares the numbers, regardless of their scales.
+func (d Decimal) Cmp(other Decimal) int {
+	if d.Sign() != other.Sign() {
+		return cmp.Compare(d.Sign(), other.Sign())
+	}
+
+	scale := max(d.scale, other.scale)
+	dHi, dLo := bits.Mul64(abs(d.value), pow10[scale-d.scale])
+	otherHi, otherLo := bits.Mul64(abs(other.value), pow10[scale-other.scale])
+
+	result := cmp.Compare(dHi, otherHi)
+	if result == 0 {
+		result = cmp.Compare(dLo, otherLo)
+	}
+	return result * d.Sign()
+}
+
+// Rescale returns d with scale fractional digits, rounding with mode if
+// digits are dropped.
+func (d Decimal) Rescale(scale int, mode RoundingMode) (Decimal, error) {
+	if scale < 0 || scale > MaxScale {
+		return Decimal{}, ErrInvalidDecimal
+	}
+
+	negative := d.value < 0
+	var magnitude uint64
+	if scale >= d.scale {
+		hi, lo := bits.Mul64(abs(d.value), pow10[scale-d.scale])
+		if hi != 0 {
+			return Decimal{}, ErrDecimalOverflow
+		}
+		magnitude = lo
+	} else {
+		divisor := pow10[d.scale-scale]
+		quotient, remainder := bits.Div64(0, abs(d.value), divisor)
+		var err error
+		if magnitude, err = round(quotient, remainder, divisor, negative, mode); err != nil {
+			return Decimal{}, err
+		}
+	}
+
+	value, err := signed(magnitude, negative)
+	return Decimal{value: value, scale: scale}, err
+}
+
+// Add returns d + other with the larger of the two scales, as do Sub, Mul
+// and Div.
+func (d Decimal) Add(other Decimal) (Decimal, error) {
+	d, other, err := sameScale(d, other)
+	if err != nil {
+		return Decimal{}, err
+	}
+
+	sum := d.value + other.value
+	if (d.value >= 0) == (other.value >= 0) && (sum >= 0) != (d.value >= 0) {
+		return Decimal{}, ErrDecimalOverflow
+	}
+	return Decimal{value: sum, scale: d.scale}, nil
+}
+
+func (d Decimal) Sub(other Decimal) (Decimal, error) {
+	d, other, err := sameScale(d, other)
+	if err != nil {
+		return Decimal{}, err
+	}
+
+	difference := d.value - other.value
+	if (d.value >= 0) != (other.value >= 0) && (difference >= 0) != (d.value >= 0) {
+		return Decimal{}, ErrDecimalOverflow
+	}
+	return Decimal{value: difference, scale: d.scale}, nil
+}
+
+// Mul returns d * other, rounded with mode.
+func (d Decimal) Mul(other Decimal, mode RoundingMode) (Decimal, error) {
+	scale := max(d.scale, other.scale)
+	negative := (d.value < 0) != (other.value < 0)
+
+	// the exact product has both scales, drop the smaller one
+	divisor := pow10[min(d.scale, other.scale)]
+	hi, lo := bits.Mul64(abs(d.value), abs(other.value))
+	if hi >= divisor {
+		return Decimal{}, ErrDecimalOverflow
+	}
+	quotient, remainder := bits.Div64(hi, lo, divisor)
+
+	magnitude, err := round(quotient, remainder, divisor, negative, mode)
+	if err != nil {
+		return Decimal{}, err
+	}
+	value, err := signed(magnitude, negative)
+	return Decimal{value: value, scale: scale}, err
+}
+
+// Div returns d / other, rounded with mode.
+func (d Decimal) Div(other Decimal, mode RoundingMode) (Decimal, error) {
+	if other.value == 0 {
+		return Decimal{}, ErrDivisionByZero
+	}
+	d, other, err := sameScale(d, other)
+	if err != nil {
+		return Decimal{}, err
+	}
+	negative := (d.value < 0) != (other.value < 0)
+
+	divisor := abs(other.value)
+	hi, lo := bits.Mul64(abs(d.value), pow10[d.scale])
+	if hi >= divisor {
+		return Decimal{}, ErrDecimalOverflow
+	}
+	quotient, remainder := bits.Div64(hi, lo, divisor)
+
+	magnitude, err := round(quotient, remainder, divisor, negative, mode)
+	if err != nil {
+		return Decimal{}, err
+	}
+	value, err := signed(magnitude, negative)
+	return Decimal{value: value, scale: d.scale}, err
+}
+
+// MarshalJSON encodes d as a string, so clients that parse JSON numbers as
+// floats do not lose digits.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON accepts a string or a number written as ParseDecimal
+// expects it. Numbers in exponent form, such as 1e2, are rejected.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+
+	parsed, err := ParseDecimal(text)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// sameScale rescales a and b to the larger of their scales.
+func sameScale(a, b Decimal) (Decimal, Decimal, error) {
+	scale := max(a.scale, b.scale)
+	a, err := a.Rescale(scale, RoundDown)
+	if err != nil {
+		return a, b, err
+	}
+	b, err = b.Rescale(scale, RoundDown)
+	return a, b, err
+}
+
+// round rounds quotient, the magnitude of a division by divisor that left
+// remainder.
+func round(quotient, remainder, divisor uint64, negative bool, mode RoundingMode) (uint64, error) {
+	if remainder == 0 {
+		return quotient, nil
+	}
+
+	var up bool
+	switch mode {
+	case RoundUp:
+		up = true
+	case RoundFloor:
+		up = negative
+	case RoundCeiling:
+		up = !negative
+	case RoundHalfUp, RoundHalfEven:
+		// compared with divisor - remainder, as 2 * remainder may overflow
+		half := cmp.Compare(remainder, divisor-remainder)
+		up = half > 0 || half == 0 && (mode == RoundHalfUp || quotient%2 == 1)
+	}
+
+	if !up {
+		return quotient, nil
+	}
+	if quotient == math.MaxUint64 {
+		return 0, ErrDecimalOverflow
+	}
+	return quotient + 1, nil
+}
+
+func abs(value int64) uint64 {
+	if value < 0 {
+		return uint64(-value)
+	}
+	return uint64(value)
+}
+
+func signed(magnitude uint64, negative bool) (int64, error) {
+	if negative && magnitude <= 1<<63 {
+		return int64(-magnitude), nil
+	}
+	if !negative && magnitude <= math.MaxInt64 {
+		return int64(magnitude), nil
+	}
+	return 0, ErrDecimalOverflow
+}
+
+func decimal(t *testing.T, s string) Decimal {
+	t.Helper()
+	d, err := ParseDecimal(s)
+	assert.NoError(t, err)
+	return d
+}
+
+func TestParseDecimal(t *testing.T) {
+	tests := map[string]struct {
+		text     string
+		value    int64
+		scale    int
+		expected string
+		err      error
+	}{
+		"integer":         {text: "42", value: 42, expected: "42"},
+		"fraction":        {text: "-12.340", value: -12340, scale: 3, expected: "-12.340"},
+		"leading point":   {text: ".5", value: 5, scale: 1, expected: "0.5"},
+		"plus sign":       {text: "+0.001", value: 1, scale: 3, expected: "0.001"},
+		"minimum":         {text: "-9.223372036854775808", value: math.MinInt64, scale: 18, expected: "-9.223372036854775808"},
+		"empty":           {text: "", err: ErrInvalidDecimal},
+		"sign only":       {text: "-", err: ErrInvalidDecimal},
+		"letters":         {text: "1.2e3", err: ErrInvalidDecimal},
+		"two points":      {text: "1.2.3", err: ErrInvalidDecimal},
+		"too many digits": {text: "0.1234567890123456789", err: ErrInvalidDecimal},
+		"overflow":        {text: "9223372036854775808", err: ErrDecimalOverflow},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			d, err := ParseDecimal(test.text)
+			assert.ErrorIs(t, err, test.err)
+			if test.err == nil {
+				assert.Equal(t, NewDecimal(test.value, test.scale), d)
+				assert.Equal(t, test.expected, d.String())
+			}
+		})
+	}
+}
+
+func TestDecimalRounding(t *testing.T) {
+	values := []string{"2.5", "-2.5", "1.5", "1.25", "-1.26", "0.4"}
+	tests := map[RoundingMode][]string{
+		RoundHalfEven: {"2", "-2", "2", "1", "-1", "0"},
+		RoundHalfUp:   {"3", "-3", "2", "1", "-1", "0"},
+		RoundDown:     {"2", "-2", "1", "1", "-1", "0"},
+		RoundUp:       {"3", "-3", "2", "2", "-2", "1"},
+		RoundFloor:    {"2", "-3", "1", "1", "-2", "0"},
+		RoundCeiling:  {"3", "-2", "2", "2", "-1", "1"},
+	}
+
+	for mode, expected := range tests {
+		t.Run(fmt.Sprint(mode), func(t *testing.T) {
+			for i, value := range values {
+				rounded, err := decimal(t, value).Rescale(0, mode)
+				assert.NoError(t, err)
+				assert.Equal(t, expected[i], rounded.String(), value)
+			}
+		})
+	}
+
+	_, err := decimal(t, "9.223372036854775807").Rescale(0, RoundDown)
+	assert.NoError(t, err)
+	_, err = decimal(t, "9223372036854775807").Rescale(1, RoundDown)
+	assert.ErrorIs(t, err, ErrDecimalOverflow)
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	tests := map[string]struct {
+		operation func(a, b Decimal) (Decimal, error)
+		a, b      string
+		expected  string
+		err       error
+	}{
+		"add exact":                 {operation: Decimal.Add, a: "0.1", b: "0.2", expected: "0.3"},
+		"add scales":                {operation: Decimal.Add, a: "10", b: "-0.25", expected: "9.75"},
+		"add overflow":              {operation: Decimal.Add, a: "9223372036854775807", b: "1", err: ErrDecimalOverflow},
+		"sub":                       {operation: Decimal.Sub, a: "1.00", b: "2.5", expected: "-1.50"},
+		"sub overflow":              {operation: Decimal.Sub, a: "-9223372036854775807", b: "2", err: ErrDecimalOverflow},
+		"align overflow":            {operation: Decimal.Add, a: "922337203685477581", b: "0.1", err: ErrDecimalOverflow},
+		"mul":                       {operation: mulHalfEven, a: "19.99", b: "3", expected: "59.97"},
+		"mul rounds":                {operation: mulHalfEven, a: "0.15", b: "0.5", expected: "0.08"},
+		"mul negative":              {operation: mulHalfEven, a: "-1.5", b: "1.5", expected: "-2.2"},
+		"mul wide":                  {operation: mulHalfEven, a: "92233720368.54775807", b: "0.50000000", expected: "46116860184.27387904"},
+		"mul overflow":              {operation: mulHalfEven, a: "4294967296", b: "4294967296", err: ErrDecimalOverflow},
+		"mul rounds up to overflow": {operation: func(a, b Decimal) (Decimal, error) { return a.Mul(b, RoundUp) }, a: "3.7", b: "498560650640798692.3", err: ErrDecimalOverflow},
+		"mul ceiling to overflow":   {operation: func(a, b Decimal) (Decimal, error) { return a.Mul(b, RoundCeiling) }, a: "3.7", b: "498560650640798692.3", err: ErrDecimalOverflow},
+		"mul floor to overflow":     {operation: func(a, b Decimal) (Decimal, error) { return a.Mul(b, RoundFloor) }, a: "-3.7", b: "498560650640798692.3", err: ErrDecimalOverflow},
+		"div":                       {operation: divHalfEven, a: "10.00", b: "3", expected: "3.33"},
+		"div rounds":                {operation: divHalfEven, a: "2.00", b: "3", expected: "0.67"},
+		"div negative":              {operation: divHalfEven, a: "1", b: "-8.000", expected: "-0.125"},
+		"div by zero":               {operation: divHalfEven, a: "1", b: "0.00", err: ErrDivisionByZero},
+		"div overflow":              {operation: divHalfEven, a: "9223372036854775807", b: "0.5", err: ErrDecimalOverflow},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := test.operation(decimal(t, test.a), decimal(t, test.b))
+			assert.ErrorIs(t, err, test.err)
+			if test.err == nil {
+				assert.Equal(t, test.expected, result.String())
+			}
+		})
+	}
+}
+
+func mulHalfEven(a, b Decimal) (Decimal, error) {
+	return a.Mul(b, RoundHalfEven)
+}
+
+func divHalfEven(a, b Decimal) (Decimal, error) {
+	return a.Div(b, RoundHalfEven)
+}
+
+func TestDecimalCmp(t *testing.T) {
+	assert.Equal(t, 0, decimal(t, "1.50").Cmp(decimal(t, "1.5")))
+	assert.Equal(t, -1, decimal(t, "-2").Cmp(decimal(t, "1.5")))
+	assert.Equal(t, -1, decimal(t, "-2").Cmp(decimal(t, "-1.999")))
+	assert.Equal(t, 1, decimal(t, "9223372036854775807").Cmp(decimal(t, "0.000000000000000001")))
+	assert.Equal(t, 0, Decimal{}.Cmp(decimal(t, "-0.00")))
+}
+
+func TestDecimalJSON(t *testing.T) {
+	type invoice struct {
+		Total Decimal  `json:"total"`
+		Tax   Decimal  `json:"tax"`
+		Fee   *Decimal `json:"fee"`
+	}
+
+	data, err := json.Marshal(invoice{Total: decimal(t, "19.99"), Tax: decimal(t, "-0.05")})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"total":"19.99","tax":"-0.05","fee":null}`, string(data))
+
+	var decoded invoice
+	assert.NoError(t, json.Unmarshal([]byte(`{"total":"19.99","tax":-0.050,"fee":null}`), &decoded))
+	assert.Equal(t, invoice{Total: decimal(t, "19.99"), Tax: decimal(t, "-0.050")}, decoded)
+
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"total":"1e3"}`), &decoded), ErrInvalidDecimal)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"total":1e2}`), &decoded), ErrInvalidDecimal)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"total":true}`), &decoded), ErrInvalidDecimal)
+}
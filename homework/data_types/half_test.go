@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v half_test.go homework_test.go
+
+// Float16 is an IEEE 754 half-precision number: 1 sign bit, 5 exponent
+// bits and 10 mantissa bits.
+type Float16 uint16
+
+// BFloat16 is the upper half of a float32: 1 sign bit, 8 exponent bits and
+// 7 mantissa bits. It keeps the range of a float32 with less precision.
+type BFloat16 uint16
+
+// NewFloat16 rounds f to the nearest Float16, ties to even. Values too large
+// become infinities and values too small subnormals or zeros.
+func NewFloat16(f float32) Float16 {
+	bits := math.Float32bits(f)
+	sign := Float16(bits>>16) & 0x8000
+	exponent := int(bits>>23) & 0xFF
+	mantissa := bits & 0x7FFFFF
+
+	if exponent == 0xFF {
+		if mantissa != 0 {
+			// keep the top of the payload, quiet so it stays a NaN
+			return sign | 0x7E00 | Float16(mantissa>>13)
+		}
+		return sign | 0x7C00
+	}
+
+	exponent += 15 - 127
+	if exponent >= 0x1F {
+		return sign | 0x7C00
+	}
+	if exponent <= 0 {
+		// subnormal, the implicit bit is shifted into the mantissa; a
+		// rounded up result becomes the smallest normal on its own
+		shift := 14 - exponent
+		if shift > 24 {
+			return sign
+		}
+		return sign | Float16(roundShift(mantissa|0x800000, shift))
+	}
+	// a rounded up mantissa carries into the exponent, up to infinity
+	return sign | Float16(uint32(exponent)<<10+roundShift(mantissa, 13))
+}
+
+// roundShift shifts x right, rounding to nearest, ties to even.
+func roundShift(x uint32, shift int) uint32 {
+	result := x >> shift
+	remainder := x & (1<<shift - 1)
+	half := uint32(1) << (shift - 1)
+	if remainder > half || remainder == half && result&1 == 1 {
+		result++
+	}
+	return result
+}
+
+// Float32 returns h exactly.
+func (h Float16) Float32() float32 {
+	sign := uint32(h&0x8000) << 16
+	exponent := uint32(h>>10) & 0x1F
+	mantissa := uint32(h & 0x3FF)
+
+	switch exponent {
+	case 0x1F:
+		return math.Float32frombits(sign | 0x7F800000 | mantissa<<13)
+	case 0:
+		// zero or subnormal, mantissa * 2^-24
+		f := float32(mantissa) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	}
+	return math.Float32frombits(sign | (exponent+127-15)<<23 | mantissa<<13)
+}
+
+func (h Float16) IsNaN() bool {
+	return h&0x7C00 == 0x7C00 && h&0x3FF != 0
+}
+
+func (h Float16) IsInf() bool {
+	return h&0x7FFF == 0x7C00
+}
+
+func (h Float16) String() string {
+	return strconv.FormatFloat(float64(h.Float32()), 'g', -1, 32)
+}
+
+// NewBFloat16 rounds f to the nearest BFloat16, ties to even.
+func NewBFloat16(f float32) BFloat16 {
+	bits := math.Float32bits(f)
+	if bits&0x7FFFFFFF > 0x7F800000 {
+		// NaN payloads may be in the dropped bits, keep it quiet
+		return BFloat16(bits>>16) | 0x0040
+	}
+	// a rounded up mantissa carries into the exponent, up to infinity
+	bits += 0x7FFF + bits>>16&1
+	return BFloat16(bits >> 16)
+}
+
+// Float32 returns b exactly.
+func (b BFloat16) Float32() float32 {
+	return math.Float32frombits(uint32(b) << 16)
+}
+
+func (b BFloat16) IsNaN() bool {
+	return b&0x7F80 == 0x7F80 && b&0x7F != 0
+}
+
+func (b BFloat16) IsInf() bool {
+	return b&0x7FFF == 0x7F80
+}
+
+func (b BFloat16) String() string {
+	return strconv.FormatFloat(float64(b.Float32()), 'g', -1, 32)
+}
+
+// HalfBytes returns the bytes of value in order.
+func HalfBytes[T Float16 | BFloat16](value T, order binary.ByteOrder) [2]byte {
+	value = FromNative(value, order)
+	return *(*[2]byte)(unsafe.Pointer(&value))
+}
+
+// HalfFromBytes returns the value stored in data in order.
+func HalfFromBytes[T Float16 | BFloat16](data [2]byte, order binary.ByteOrder) T {
+	return FromNative(*(*T)(unsafe.Pointer(&data)), order)
+}
+
+func TestFloat16(t *testing.T) {
+	tests := map[string]struct {
+		value    float32
+		half     Float16
+		expected float32
+	}{
+		"one":                 {value: 1, half: 0x3C00, expected: 1},
+		"minus two":           {value: -2, half: 0xC000, expected: -2},
+		"negative zero":       {value: float32(math.Copysign(0, -1)), half: 0x8000, expected: float32(math.Copysign(0, -1))},
+		"tenth":               {value: 0.1, half: 0x2E66, expected: 0.099975586},
+		"max":                 {value: 65504, half: 0x7BFF, expected: 65504},
+		"below overflow":      {value: 65519, half: 0x7BFF, expected: 65504},
+		"overflow":            {value: 65520, half: 0x7C00, expected: float32(math.Inf(1))},
+		"large":               {value: 1e10, half: 0x7C00, expected: float32(math.Inf(1))},
+		"infinity":            {value: float32(math.Inf(-1)), half: 0xFC00, expected: float32(math.Inf(-1))},
+		"tie to even":         {value: 1 + 1.0/(1<<11), half: 0x3C00, expected: 1},
+		"tie to odd":          {value: 1 + 3.0/(1<<11), half: 0x3C02, expected: 1 + 2.0/(1<<10)},
+		"smallest normal":     {value: 1.0 / (1 << 14), half: 0x0400, expected: 1.0 / (1 << 14)},
+		"rounds to normal":    {value: 1.0/(1<<14) - 1.0/(1<<26), half: 0x0400, expected: 1.0 / (1 << 14)},
+		"largest subnormal":   {value: 1023.0 / (1 << 24), half: 0x03FF, expected: 1023.0 / (1 << 24)},
+		"smallest subnormal":  {value: 1.0 / (1 << 24), half: 0x0001, expected: 1.0 / (1 << 24)},
+		"subnormal tie":       {value: 1.0 / (1 << 25), half: 0x0000, expected: 0},
+		"above subnormal tie": {value: 3.0 / (1 << 26), half: 0x0001, expected: 1.0 / (1 << 24)},
+		"underflow":           {value: -1e-10, half: 0x8000, expected: float32(math.Copysign(0, -1))},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			half := NewFloat16(test.value)
+			assert.Equal(t, test.half, half)
+			assert.Equal(t, math.Float32bits(test.expected), math.Float32bits(half.Float32()))
+		})
+	}
+
+	nan := NewFloat16(float32(math.NaN()))
+	assert.True(t, nan.IsNaN())
+	assert.True(t, math.IsNaN(float64(nan.Float32())))
+	// a payload only in the dropped bits still gives a NaN
+	assert.True(t, NewFloat16(math.Float32frombits(0x7F800001)).IsNaN())
+	assert.True(t, Float16(0xFC00).IsInf())
+	assert.False(t, Float16(0x7C01).IsInf())
+	assert.Equal(t, "-0.5", NewFloat16(-0.5).String())
+}
+
+func TestFloat16Exhaustive(t *testing.T) {
+	for i := range 1 << 16 {
+		half := Float16(i)
+		f := half.Float32()
+		if half.IsNaN() {
+			assert.True(t, math.IsNaN(float64(f)))
+			continue
+		}
+
+		// the reference decodes the fields with float64 arithmetic
+		exponent, mantissa := int(i>>10&0x1F), float64(i&0x3FF)
+		expected := math.Ldexp(1+mantissa/1024, exponent-15)
+		if exponent == 0 {
+			expected = math.Ldexp(mantissa/1024, -14)
+		} else if exponent == 0x1F {
+			expected = math.Inf(1)
+		}
+		if i&0x8000 != 0 {
+			expected = -expected
+		}
+
+		assert.Equal(t, expected, float64(f))
+		assert.Equal(t, half, NewFloat16(f))
+	}
+}
+
+func TestBFloat16(t *testing.T) {
+	tests := map[string]struct {
+		value    float32
+		half     BFloat16
+		expected float32
+	}{
+		"one":         {value: 1, half: 0x3F80, expected: 1},
+		"pi":          {value: math.Pi, half: 0x4049, expected: 3.140625},
+		"tie to even": {value: 1 + 1.0/(1<<8), half: 0x3F80, expected: 1},
+		"tie to odd":  {value: 1 + 3.0/(1<<8), half: 0x3F82, expected: 1 + 2.0/(1<<7)},
+		"overflow":    {value: math.MaxFloat32, half: 0x7F80, expected: float32(math.Inf(1))},
+		"infinity":    {value: float32(math.Inf(-1)), half: 0xFF80, expected: float32(math.Inf(-1))},
+		"subnormal":   {value: 1e-40, half: 0x0001, expected: math.Float32frombits(0x00010000)},
+		"large":       {value: 1e30, half: 0x714A, expected: math.Float32frombits(0x714A0000)},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			half := NewBFloat16(test.value)
+			assert.Equal(t, test.half, half)
+			assert.Equal(t, test.expected, half.Float32())
+			assert.Equal(t, half, NewBFloat16(half.Float32()))
+		})
+	}
+
+	assert.True(t, NewBFloat16(float32(math.NaN())).IsNaN())
+	assert.True(t, NewBFloat16(math.Float32frombits(0x7F800001)).IsNaN())
+	assert.True(t, BFloat16(0x7F80).IsInf())
+	assert.False(t, BFloat16(0x7F80).IsNaN())
+	assert.Equal(t, "3.140625", NewBFloat16(math.Pi).String())
+}
+
+func TestHalfBytes(t *testing.T) {
+	half := NewFloat16(1.5)
+	assert.Equal(t, [2]byte{0x3E, 0x00}, HalfBytes(half, binary.BigEndian))
+	assert.Equal(t, [2]byte{0x00, 0x3E}, HalfBytes(half, binary.LittleEndian))
+	assert.Equal(t, half, HalfFromBytes[Float16]([2]byte{0x3E, 0x00}, binary.BigEndian))
+	assert.Equal(t, half, HalfFromBytes[Float16]([2]byte{0x00, 0x3E}, binary.LittleEndian))
+
+	bhalf := NewBFloat16(-2)
+	data := HalfBytes(bhalf, binary.BigEndian)
+	assert.Equal(t, [2]byte{0xC0, 0x00}, data)
+	assert.Equal(t, bhalf, HalfFromBytes[BFloat16](data, binary.BigEndian))
+	data = HalfBytes(bhalf, binary.LittleEndian)
+	assert.Equal(t, uint16(bhalf), binary.LittleEndian.Uint16(data[:]))
+}
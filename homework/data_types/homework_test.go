@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/binary"
+	"math"
+	"math/bits"
 	"testing"
 	"unsafe"
 
@@ -13,15 +16,105 @@ func ToLittleEndian(number uint32) uint32 {
 	return (number>>24)&0xff | (number>>8)&0xff00 | (number<<8)&0xff0000 | (number<<24)&0xff000000
 }
 
-func ToLittleEndianGeneric[T ~uint16 | ~uint32 | ~uint64](number T) T {
-	var result T
-	unsPointerNumber := unsafe.Pointer(&number)
-	for i := 0; i < int(unsafe.Sizeof(number)); i++ {
-		c := *(*byte)(unsafe.Add(unsPointerNumber, i))
-		result = (result << 8) | T(c)
+// Uint128 is an unsigned 128-bit integer, Hi<<64 | Lo. Hi comes first in
+// memory whatever the host order, so converting its byte order moves the
+// halves as well as the bytes inside them.
+type Uint128 struct {
+	Hi, Lo uint64
+}
+
+// Fixed is a fixed-width value whose byte order can be converted.
+type Fixed interface {
+	~uint8 | ~uint16 | ~uint32 | ~uint64 | ~int8 | ~int16 | ~int32 | ~int64 | ~float32 | ~float64 | Uint128
+}
+
+// ToLittleEndianGeneric swaps the bytes of number whatever the host order,
+// floats are swapped through their bit patterns and a Uint128 as a whole, so
+// the swapped Hi is the swapped Lo. It converts between little and big
+// endian values in either direction, FromNative converts from the host
+// order.
+func ToLittleEndianGeneric[T Fixed](number T) T {
+	// the size is constant for every instantiation, so only one case is
+	// compiled in and the swap is a single instruction
+	pointer := unsafe.Pointer(&number)
+	switch unsafe.Sizeof(number) {
+	case 2:
+		*(*uint16)(pointer) = bits.ReverseBytes16(*(*uint16)(pointer))
+	case 4:
+		*(*uint32)(pointer) = bits.ReverseBytes32(*(*uint32)(pointer))
+	case 8:
+		*(*uint64)(pointer) = bits.ReverseBytes64(*(*uint64)(pointer))
+	case 16:
+		value := (*Uint128)(pointer)
+		value.Hi, value.Lo = bits.ReverseBytes64(value.Lo), bits.ReverseBytes64(value.Hi)
 	}
+	return number
+}
 
-	return result
+// ToBigEndian converts number from the host byte order to big endian, so its
+// bytes in memory are in network order. It only swaps on little-endian
+// hosts, unlike ToLittleEndianGeneric.
+func ToBigEndian[T Fixed](number T) T {
+	return FromNative(number, binary.BigEndian)
+}
+
+var nativeOrder = detectOrder()
+
+var nativeBig = nativeOrder == binary.BigEndian
+
+func detectOrder() binary.ByteOrder {
+	number := uint16(0x0102)
+	if *(*byte)(unsafe.Pointer(&number)) == 0x02 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// NativeOrder returns the byte order of the host.
+func NativeOrder() binary.ByteOrder {
+	return nativeOrder
+}
+
+// FromNative converts number from the host byte order to order, so its
+// bytes in memory are laid out as order requires. Converting twice returns
+// the original value, so FromNative also converts back to the host order.
+// order is binary.LittleEndian, binary.BigEndian or binary.NativeEndian.
+func FromNative[T Fixed](number T, order binary.ByteOrder) T {
+	big := isOrder(order, binary.BigEndian) || nativeBig && isOrder(order, binary.NativeEndian)
+	if unsafe.Sizeof(number) == 16 {
+		// Uint128 is the only 16 byte Fixed type
+		value := fromNative128(*(*Uint128)(unsafe.Pointer(&number)), big)
+		return *(*T)(unsafe.Pointer(&value))
+	}
+	if big == nativeBig {
+		return number
+	}
+	return ToLittleEndianGeneric(number)
+}
+
+// isOrder reports whether order has the type of want. The byte orders of
+// encoding/binary are empty structs, so their type is their identity, and a
+// type assertion avoids the runtime call of an interface comparison.
+func isOrder[T binary.ByteOrder](order binary.ByteOrder, want T) bool {
+	_, ok := order.(T)
+	return ok
+}
+
+// fromNative128 lays value out in memory as a single 128-bit number, big or
+// little endian, Hi and Lo are stored in host order. It is not inlined so
+// that FromNative stays small enough to be inlined itself.
+//
+//go:noinline
+func fromNative128(value Uint128, big bool) Uint128 {
+	var data [16]byte
+	if big {
+		binary.BigEndian.PutUint64(data[:8], value.Hi)
+		binary.BigEndian.PutUint64(data[8:], value.Lo)
+	} else {
+		binary.LittleEndian.PutUint64(data[:8], value.Lo)
+		binary.LittleEndian.PutUint64(data[8:], value.Hi)
+	}
+	return *(*Uint128)(unsafe.Pointer(&data))
 }
 
 func TestСonversion(t *testing.T) {
@@ -93,3 +186,111 @@ func TestСonversionGeneric(t *testing.T) {
 		})
 	}
 }
+
+func TestConversionFixed(t *testing.T) {
+	tests := map[string]struct {
+		convert func() any
+		result  any
+	}{
+		"uint8": {
+			convert: func() any { return ToLittleEndianGeneric(uint8(0x12)) },
+			result:  uint8(0x12),
+		},
+		"uint64": {
+			convert: func() any { return ToLittleEndianGeneric(uint64(0x0102030405060708)) },
+			result:  uint64(0x0807060504030201),
+		},
+		"int8": {
+			convert: func() any { return ToLittleEndianGeneric(int8(-2)) },
+			result:  int8(-2),
+		},
+		"int16": {
+			convert: func() any { return ToLittleEndianGeneric(int16(-2)) },
+			result:  int16(-257),
+		},
+		"int32": {
+			convert: func() any { return ToLittleEndianGeneric(int32(0x01020304)) },
+			result:  int32(0x04030201),
+		},
+		"int64": {
+			convert: func() any { return ToLittleEndianGeneric(int64(-1)) },
+			result:  int64(-1),
+		},
+		"float32": {
+			convert: func() any { return math.Float32bits(ToLittleEndianGeneric(float32(1.5))) },
+			result:  uint32(0x0000C03F),
+		},
+		"float64": {
+			convert: func() any { return math.Float64bits(ToLittleEndianGeneric(float64(-2))) },
+			result:  uint64(0x00000000000000C0),
+		},
+		"uint128": {
+			convert: func() any {
+				return ToLittleEndianGeneric(Uint128{Hi: 0x0001020304050607, Lo: 0x08090A0B0C0D0E0F})
+			},
+			result: Uint128{Hi: 0x0F0E0D0C0B0A0908, Lo: 0x0706050403020100},
+		},
+		"swapped back": {
+			convert: func() any { return ToLittleEndianGeneric(ToLittleEndianGeneric(int32(0x01020304))) },
+			result:  int32(0x01020304),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.result, test.convert())
+		})
+	}
+}
+
+func TestFromNative(t *testing.T) {
+	bytes := func(number uint32) []byte {
+		return unsafe.Slice((*byte)(unsafe.Pointer(&number)), 4)
+	}
+
+	number := uint32(0x01020304)
+	assert.Equal(t, binary.BigEndian.AppendUint32(nil, number), bytes(FromNative(number, binary.BigEndian)))
+	assert.Equal(t, binary.LittleEndian.AppendUint32(nil, number), bytes(FromNative(number, binary.LittleEndian)))
+	assert.Equal(t, number, FromNative(number, binary.NativeEndian))
+	assert.Equal(t, number, FromNative(number, NativeOrder()))
+	assert.Equal(t, number, FromNative(FromNative(number, binary.BigEndian), binary.BigEndian))
+
+	// network order readings of a sensor
+	temperature := math.Float32frombits(binary.BigEndian.Uint32([]byte{0xC1, 0x20, 0x00, 0x00}))
+	raw := *(*float32)(unsafe.Pointer(&[]byte{0xC1, 0x20, 0x00, 0x00}[0]))
+	assert.Equal(t, temperature, FromNative(raw, binary.BigEndian))
+	assert.Equal(t, float32(-10), temperature)
+
+	assert.Equal(t, binary.NativeEndian.Uint16([]byte{1, 2}), NativeOrder().Uint16([]byte{1, 2}))
+}
+
+func TestToBigEndian(t *testing.T) {
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, binary.NativeEndian.AppendUint32(nil, ToBigEndian(uint32(0x01020304))))
+	assert.Equal(t, []byte{0xFF, 0xFE}, binary.NativeEndian.AppendUint16(nil, uint16(ToBigEndian(int16(-2)))))
+	assert.Equal(t, []byte{0xC1, 0x20, 0x00, 0x00}, binary.NativeEndian.AppendUint32(nil, math.Float32bits(ToBigEndian(float32(-10)))))
+
+	number := ToBigEndian(Uint128{Hi: 0x0001020304050607, Lo: 0x08090A0B0C0D0E0F})
+	assert.Equal(t, []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F},
+		unsafe.Slice((*byte)(unsafe.Pointer(&number)), 16))
+
+	// converting twice returns to the host order
+	assert.Equal(t, int64(-3), ToBigEndian(ToBigEndian(int64(-3))))
+}
+
+func TestFromNativeUint128(t *testing.T) {
+	bytes := func(number Uint128) []byte {
+		return unsafe.Slice((*byte)(unsafe.Pointer(&number)), 16)
+	}
+
+	number := Uint128{Hi: 0x0001020304050607, Lo: 0x08090A0B0C0D0E0F}
+	big := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F}
+	little := []byte{0x0F, 0x0E, 0x0D, 0x0C, 0x0B, 0x0A, 0x09, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01, 0x00}
+
+	assert.Equal(t, big, bytes(FromNative(number, binary.BigEndian)))
+	assert.Equal(t, little, bytes(FromNative(number, binary.LittleEndian)))
+	assert.Equal(t, bytes(FromNative(number, NativeOrder())), bytes(FromNative(number, binary.NativeEndian)))
+
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian, binary.NativeEndian} {
+		assert.Equal(t, number, FromNative(FromNative(number, order), order), order.String())
+	}
+}
@@ -0,0 +1,100 @@
+// Code generated by schemagen from packet.schema; DO NOT EDIT.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// go test -v packet_gen_test.go homework_test.go
+
+type PacketHeader struct {
+	Magic      uint32
+	Version    uint8
+	Flags      uint8
+	Sequence   uint16
+	Timestamp  int64
+	_          [2]uint8
+	SampleRate float32
+	Checksum   uint32
+}
+
+const PacketHeaderSize = 26
+
+func (v *PacketHeader) MarshalBinary() ([]byte, error) {
+	return v.AppendBinary(make([]byte, 0, PacketHeaderSize))
+}
+
+func (v *PacketHeader) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, make([]byte, PacketHeaderSize)...)
+	data := b[len(b)-PacketHeaderSize:]
+	binary.NativeEndian.PutUint32(data[0:], FromNative(v.Magic, binary.BigEndian))
+	data[4] = v.Version
+	data[5] = v.Flags
+	binary.NativeEndian.PutUint16(data[6:], FromNative(v.Sequence, binary.BigEndian))
+	binary.NativeEndian.PutUint64(data[8:], uint64(FromNative(v.Timestamp, binary.BigEndian)))
+	binary.NativeEndian.PutUint32(data[18:], FromNative(math.Float32bits(v.SampleRate), binary.BigEndian))
+	binary.NativeEndian.PutUint32(data[22:], FromNative(v.Checksum, binary.LittleEndian))
+	return b, nil
+}
+
+func (v *PacketHeader) UnmarshalBinary(data []byte) error {
+	if len(data) < PacketHeaderSize {
+		return io.ErrUnexpectedEOF
+	}
+	v.Magic = FromNative(binary.NativeEndian.Uint32(data[0:]), binary.BigEndian)
+	v.Version = data[4]
+	v.Flags = data[5]
+	v.Sequence = FromNative(binary.NativeEndian.Uint16(data[6:]), binary.BigEndian)
+	v.Timestamp = FromNative(int64(binary.NativeEndian.Uint64(data[8:])), binary.BigEndian)
+	v.SampleRate = math.Float32frombits(FromNative(binary.NativeEndian.Uint32(data[18:]), binary.BigEndian))
+	v.Checksum = FromNative(binary.NativeEndian.Uint32(data[22:]), binary.LittleEndian)
+	return nil
+}
+
+type SensorFrame struct {
+	Sensor  uint16
+	Samples [8]int16
+	Scale   float64
+	Offsets [3]float32
+	Status  int8
+}
+
+const SensorFrameSize = 39
+
+func (v *SensorFrame) MarshalBinary() ([]byte, error) {
+	return v.AppendBinary(make([]byte, 0, SensorFrameSize))
+}
+
+func (v *SensorFrame) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, make([]byte, SensorFrameSize)...)
+	data := b[len(b)-SensorFrameSize:]
+	binary.NativeEndian.PutUint16(data[0:], FromNative(v.Sensor, binary.BigEndian))
+	for i, x := range v.Samples {
+		binary.NativeEndian.PutUint16(data[2+i*2:], uint16(FromNative(x, binary.BigEndian)))
+	}
+	binary.NativeEndian.PutUint64(data[18:], FromNative(math.Float64bits(v.Scale), binary.LittleEndian))
+	for i, x := range v.Offsets {
+		binary.NativeEndian.PutUint32(data[26+i*4:], FromNative(math.Float32bits(x), binary.BigEndian))
+	}
+	data[38] = byte(v.Status)
+	return b, nil
+}
+
+func (v *SensorFrame) UnmarshalBinary(data []byte) error {
+	if len(data) < SensorFrameSize {
+		return io.ErrUnexpectedEOF
+	}
+	v.Sensor = FromNative(binary.NativeEndian.Uint16(data[0:]), binary.BigEndian)
+	for i := range v.Samples {
+		v.Samples[i] = FromNative(int16(binary.NativeEndian.Uint16(data[2+i*2:])), binary.BigEndian)
+	}
+	v.Scale = math.Float64frombits(FromNative(binary.NativeEndian.Uint64(data[18:]), binary.LittleEndian))
+	for i := range v.Offsets {
+		v.Offsets[i] = math.Float32frombits(FromNative(binary.NativeEndian.Uint32(data[26+i*4:]), binary.BigEndian))
+	}
+	v.Status = int8(data[38])
+	return nil
+}
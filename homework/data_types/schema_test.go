@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v schema_test.go packet_gen_test.go homework_test.go codec_test.go
+
+//go:generate go run ./schemagen packet.schema
+
+// taggedPacketHeader is PacketHeader laid out by the reflection codec.
+type taggedPacketHeader struct {
+	Magic      uint32 `bin:"be"`
+	Version    uint8
+	Flags      uint8
+	Sequence   uint16 `bin:"be"`
+	Timestamp  int64  `bin:"be"`
+	_          [2]uint8
+	SampleRate float32 `bin:"be"`
+	Checksum   uint32  `bin:"le"`
+}
+
+func TestGeneratedCodec(t *testing.T) {
+	header := PacketHeader{
+		Magic:      0x54454C45,
+		Version:    2,
+		Flags:      0x81,
+		Sequence:   0x0102,
+		Timestamp:  -2,
+		SampleRate: 1.5,
+		Checksum:   0xAABBCCDD,
+	}
+
+	data, err := header.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x54, 0x45, 0x4C, 0x45, // magic
+		0x02, 0x81, // version, flags
+		0x01, 0x02, // sequence
+		0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE, // timestamp
+		0x00, 0x00, // padding
+		0x3F, 0xC0, 0x00, 0x00, // sample rate
+		0xDD, 0xCC, 0xBB, 0xAA, // checksum, little endian
+	}, data)
+	assert.Len(t, data, PacketHeaderSize)
+
+	// the reflection codec agrees on the layout
+	expected, err := Encode(taggedPacketHeader(header))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, data)
+
+	var decoded PacketHeader
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, header, decoded)
+	assert.ErrorIs(t, decoded.UnmarshalBinary(data[:PacketHeaderSize-1]), io.ErrUnexpectedEOF)
+
+	appended, err := header.AppendBinary([]byte("prefix"))
+	assert.NoError(t, err)
+	assert.Equal(t, append([]byte("prefix"), data...), appended)
+}
+
+func TestGeneratedCodecArrays(t *testing.T) {
+	frame := SensorFrame{
+		Sensor:  7,
+		Samples: [8]int16{-1, 0, 1, 2, 3, 4, 5, math.MinInt16},
+		Scale:   math.Pi,
+		Offsets: [3]float32{0.25, -0.5, float32(math.Inf(1))},
+		Status:  -3,
+	}
+
+	data, err := frame.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Len(t, data, SensorFrameSize)
+	assert.Equal(t, uint16(7), binary.BigEndian.Uint16(data))
+	assert.Equal(t, uint16(0xFFFF), binary.BigEndian.Uint16(data[2:]))
+	assert.Equal(t, uint16(0x8000), binary.BigEndian.Uint16(data[16:]))
+	assert.Equal(t, math.Pi, math.Float64frombits(binary.LittleEndian.Uint64(data[18:])))
+	assert.Equal(t, float32(-0.5), math.Float32frombits(binary.BigEndian.Uint32(data[30:])))
+	assert.Equal(t, byte(0xFD), data[38])
+
+	var decoded SensorFrame
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, frame, decoded)
+}
+
+func BenchmarkGeneratedCodec(b *testing.B) {
+	header := PacketHeader{Magic: 0x54454C45, Sequence: 1, Timestamp: 1 << 40, SampleRate: 48000}
+	data, _ := header.MarshalBinary()
+
+	b.Run("generated encode", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]byte, 0, PacketHeaderSize)
+		for i := 0; i < b.N; i++ {
+			buf, _ = header.AppendBinary(buf[:0])
+		}
+	})
+
+	b.Run("generated decode", func(b *testing.B) {
+		b.ReportAllocs()
+		var decoded PacketHeader
+		for i := 0; i < b.N; i++ {
+			_ = decoded.UnmarshalBinary(data)
+		}
+	})
+
+	b.Run("reflection encode", func(b *testing.B) {
+		b.ReportAllocs()
+		tagged := taggedPacketHeader(header)
+		for i := 0; i < b.N; i++ {
+			_, _ = Encode(&tagged)
+		}
+	})
+
+	b.Run("reflection decode", func(b *testing.B) {
+		b.ReportAllocs()
+		var decoded taggedPacketHeader
+		for i := 0; i < b.N; i++ {
+			_ = Decode(data, &decoded)
+		}
+	})
+}
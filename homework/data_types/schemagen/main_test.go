@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v main_test.go main.go
+
+func TestParse(t *testing.T) {
+	schema, err := Parse("test.schema", strings.NewReader(`
+		order be  # network order
+
+		struct Point {
+			x_offset  int32
+			_         [3]uint8
+			values    [2]float64 le
+		}
+	`))
+	assert.NoError(t, err)
+	assert.Equal(t, &Schema{Structs: []Struct{{
+		Name: "Point",
+		Fields: []Field{
+			{Name: "XOffset", Type: "int32", Order: "BigEndian"},
+			{Name: "_", Type: "uint8", Count: 3, Order: "BigEndian"},
+			{Name: "Values", Type: "float64", Count: 2, Order: "LittleEndian"},
+		},
+	}}}, schema)
+	assert.Equal(t, 23, schema.Structs[0].Size())
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]struct {
+		schema string
+		err    string
+	}{
+		"unknown order":    {schema: "order middle", err: "test.schema:1: expected order le or order be"},
+		"field outside":    {schema: "x uint8", err: `test.schema:1: unexpected "x" outside of a struct`},
+		"bad struct":       {schema: "struct 1Point {", err: "test.schema:1: expected struct Name {"},
+		"unknown type":     {schema: "struct P {\nx uint128\n}", err: `test.schema:2: unknown type "uint128"`},
+		"bad array":        {schema: "struct P {\nx [0]uint8\n}", err: `test.schema:2: invalid array length "0"`},
+		"field order":      {schema: "struct P {\nx uint16 pdp\n}", err: `test.schema:2: unknown byte order "pdp"`},
+		"field name":       {schema: "struct P {\nx__y uint8\n}", err: `test.schema:2: invalid field name "x__y"`},
+		"duplicate field":  {schema: "struct P {\nx uint8\nx uint16\n}", err: "test.schema:3: field X is declared twice"},
+		"empty struct":     {schema: "struct P {\n}", err: "test.schema:2: struct P has no fields"},
+		"duplicate struct": {schema: "struct P {\nx uint8\n}\nstruct P {", err: "test.schema:4: struct P is declared twice"},
+		"not closed":       {schema: "struct P {\nx uint8", err: "test.schema: struct P is not closed"},
+		"method field":     {schema: "struct P {\nmarshal_binary uint8\n}", err: "test.schema:2: field MarshalBinary collides with a generated method"},
+		"constant field":   {schema: "struct P {\np_size uint8\n}", err: "test.schema:2: field PSize collides with the constant PSize"},
+		"constant struct":  {schema: "struct P {\nx uint8\n}\nstruct PSize {", err: "test.schema:4: struct PSize collides with the constant PSize"},
+		"struct constant":  {schema: "struct PSize {\nx uint8\n}\nstruct P {", err: "test.schema:4: constant PSize collides with struct PSize"},
+		"import struct":    {schema: "struct binary {", err: "test.schema:1: struct binary collides with a name used by the generated code"},
+		"helper struct":    {schema: "struct FromNative {", err: "test.schema:1: struct FromNative collides with a name used by the generated code"},
+		"type struct":      {schema: "struct uint32 {", err: "test.schema:1: struct uint32 collides with a predeclared identifier"},
+		"builtin struct":   {schema: "struct len {", err: "test.schema:1: struct len collides with a predeclared identifier"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse("test.schema", strings.NewReader(test.schema))
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	schema, err := Parse("test.schema", strings.NewReader("struct Flags {\nvalue uint8\n_ [2]uint16\n}"))
+	assert.NoError(t, err)
+
+	code, err := Generate(schema, "main", "test.schema", "test_gen_test.go")
+	assert.NoError(t, err)
+
+	// padding and single bytes need neither encoding/binary nor math
+	source := string(code)
+	assert.Contains(t, source, "const FlagsSize = 5")
+	assert.Contains(t, source, "data[0] = v.Value")
+	assert.Contains(t, source, "v.Value = data[0]")
+	assert.NotContains(t, source, "encoding/binary")
+	assert.NotContains(t, source, "math")
+}
+
+func TestGenerateByteOrder(t *testing.T) {
+	schema, err := Parse("test.schema", strings.NewReader("order be\nstruct Sample {\nvalue int16\nrate float32 le\n}"))
+	assert.NoError(t, err)
+
+	code, err := Generate(schema, "main", "test.schema", "test_gen_test.go")
+	assert.NoError(t, err)
+
+	// the byte order of every field is fixed in the generated code
+	source := string(code)
+	assert.Contains(t, source, "binary.NativeEndian.PutUint16(data[0:], uint16(FromNative(v.Value, binary.BigEndian)))")
+	assert.Contains(t, source, "binary.NativeEndian.PutUint32(data[2:], FromNative(math.Float32bits(v.Rate), binary.LittleEndian))")
+	assert.Contains(t, source, "v.Value = FromNative(int16(binary.NativeEndian.Uint16(data[0:])), binary.BigEndian)")
+	assert.Contains(t, source, "v.Rate = math.Float32frombits(FromNative(binary.NativeEndian.Uint32(data[2:]), binary.LittleEndian))")
+}
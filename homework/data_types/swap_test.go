@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v swap_test.go homework_test.go
+
+// SwapSlice16 reverses the byte order of every value in place. Values are
+// swapped four at a time as 64-bit words, the head and tail that do not
+// fill an aligned word one at a time.
+func SwapSlice16(s []uint16) {
+	head, words, tail := splitWords(s)
+	for i := range head {
+		head[i] = bits.ReverseBytes16(head[i])
+	}
+
+	i := 0
+	for ; i+4 <= len(words); i += 4 {
+		w := words[i : i+4 : i+4]
+		w[0], w[1], w[2], w[3] = swap16x4(w[0]), swap16x4(w[1]), swap16x4(w[2]), swap16x4(w[3])
+	}
+	for ; i < len(words); i++ {
+		words[i] = swap16x4(words[i])
+	}
+
+	for i := range tail {
+		tail[i] = bits.ReverseBytes16(tail[i])
+	}
+}
+
+// SwapSlice32 reverses the byte order of every value in place, two at a time
+// as 64-bit words.
+func SwapSlice32(s []uint32) {
+	head, words, tail := splitWords(s)
+	for i := range head {
+		head[i] = bits.ReverseBytes32(head[i])
+	}
+
+	i := 0
+	for ; i+4 <= len(words); i += 4 {
+		w := words[i : i+4 : i+4]
+		w[0], w[1], w[2], w[3] = swap32x2(w[0]), swap32x2(w[1]), swap32x2(w[2]), swap32x2(w[3])
+	}
+	for ; i < len(words); i++ {
+		words[i] = swap32x2(words[i])
+	}
+
+	for i := range tail {
+		tail[i] = bits.ReverseBytes32(tail[i])
+	}
+}
+
+// SwapSlice64 reverses the byte order of every value in place.
+func SwapSlice64(s []uint64) {
+	i := 0
+	for ; i+4 <= len(s); i += 4 {
+		w := s[i : i+4 : i+4]
+		w[0], w[1], w[2], w[3] = bits.ReverseBytes64(w[0]), bits.ReverseBytes64(w[1]),
+			bits.ReverseBytes64(w[2]), bits.ReverseBytes64(w[3])
+	}
+	for ; i < len(s); i++ {
+		s[i] = bits.ReverseBytes64(s[i])
+	}
+}
+
+// swap16x4 swaps the bytes of each 16-bit lane of x.
+func swap16x4(x uint64) uint64 {
+	return (x>>8)&0x00FF00FF00FF00FF | (x<<8)&0xFF00FF00FF00FF00
+}
+
+// swap32x2 swaps the bytes of each 32-bit lane of x: reversing all bytes
+// also exchanges the lanes, the rotation puts them back.
+func swap32x2(x uint64) uint64 {
+	return bits.RotateLeft64(bits.ReverseBytes64(x), 32)
+}
+
+// splitWords splits s into a head before the first 8-byte aligned value, the
+// 64-bit words that follow and the tail that does not fill a word.
+func splitWords[T uint16 | uint32](s []T) (head []T, words []uint64, tail []T) {
+	size := int(unsafe.Sizeof(T(0)))
+	perWord := 8 / size
+
+	start := 0
+	for start < len(s) && uintptr(unsafe.Pointer(&s[start]))%8 != 0 {
+		start++
+	}
+
+	count := (len(s) - start) / perWord
+	end := start + count*perWord
+	if count > 0 {
+		words = unsafe.Slice((*uint64)(unsafe.Pointer(&s[start])), count)
+	}
+	return s[:start], words, s[end:]
+}
+
+func TestSwapSlice(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for _, length := range []int{0, 1, 3, 4, 7, 8, 9, 17, 33, 100} {
+		for _, offset := range []int{0, 1, 2, 3} {
+			if offset > length {
+				continue
+			}
+
+			t.Run(fmt.Sprintf("length %d offset %d", length, offset), func(t *testing.T) {
+				values16 := make([]uint16, length)
+				values32 := make([]uint32, length)
+				values64 := make([]uint64, length)
+				for i := range length {
+					values64[i] = random.Uint64()
+					values32[i] = uint32(values64[i])
+					values16[i] = uint16(values64[i])
+				}
+
+				expected16 := slices.Clone(values16[offset:])
+				for i := range expected16 {
+					expected16[i] = ToLittleEndianGeneric(expected16[i])
+				}
+				SwapSlice16(values16[offset:])
+				assert.Equal(t, expected16, values16[offset:])
+
+				expected32 := slices.Clone(values32[offset:])
+				for i := range expected32 {
+					expected32[i] = ToLittleEndian(expected32[i])
+				}
+				SwapSlice32(values32[offset:])
+				assert.Equal(t, expected32, values32[offset:])
+
+				expected64 := slices.Clone(values64[offset:])
+				for i := range expected64 {
+					expected64[i] = ToLittleEndianGeneric(expected64[i])
+				}
+				SwapSlice64(values64[offset:])
+				assert.Equal(t, expected64, values64[offset:])
+			})
+		}
+	}
+}
+
+func TestSwapSliceExamples(t *testing.T) {
+	values16 := []uint16{0x0102, 0x0304, 0x0506, 0x0708, 0x090A}
+	SwapSlice16(values16)
+	assert.Equal(t, []uint16{0x0201, 0x0403, 0x0605, 0x0807, 0x0A09}, values16)
+
+	values32 := []uint32{0x01020304, 0x05060708, 0x090A0B0C}
+	SwapSlice32(values32)
+	assert.Equal(t, []uint32{0x04030201, 0x08070605, 0x0C0B0A09}, values32)
+}
+
+const swapBenchmarkSize = 1 << 20
+
+func BenchmarkSwapSlice32(b *testing.B) {
+	values := make([]uint32, swapBenchmarkSize/4)
+	bytes := unsafe.Slice((*byte)(unsafe.Pointer(&values[0])), swapBenchmarkSize)
+
+	benchmarks := map[string]func(){
+		"SwapSlice32": func() { SwapSlice32(values) },
+		"encoding/binary": func() {
+			for i := range values {
+				values[i] = binary.BigEndian.Uint32(bytes[i*4:])
+			}
+		},
+		"ToLittleEndian": func() {
+			for i := range values {
+				values[i] = ToLittleEndian(values[i])
+			}
+		},
+		"ToLittleEndianGeneric": func() {
+			for i := range values {
+				values[i] = ToLittleEndianGeneric(values[i])
+			}
+		},
+	}
+
+	for name, swap := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(swapBenchmarkSize)
+			for i := 0; i < b.N; i++ {
+				swap()
+			}
+		})
+	}
+}
+
+func BenchmarkSwapSlice16(b *testing.B) {
+	values := make([]uint16, swapBenchmarkSize/2)
+	bytes := unsafe.Slice((*byte)(unsafe.Pointer(&values[0])), swapBenchmarkSize)
+
+	benchmarks := map[string]func(){
+		"SwapSlice16": func() { SwapSlice16(values) },
+		"encoding/binary": func() {
+			for i := range values {
+				values[i] = binary.BigEndian.Uint16(bytes[i*2:])
+			}
+		},
+		"ToLittleEndianGeneric": func() {
+			for i := range values {
+				values[i] = ToLittleEndianGeneric(values[i])
+			}
+		},
+	}
+
+	for name, swap := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(swapBenchmarkSize)
+			for i := 0; i < b.N; i++ {
+				swap()
+			}
+		})
+	}
+}
+
+func BenchmarkSwapSlice64(b *testing.B) {
+	values := make([]uint64, swapBenchmarkSize/8)
+	bytes := unsafe.Slice((*byte)(unsafe.Pointer(&values[0])), swapBenchmarkSize)
+
+	benchmarks := map[string]func(){
+		"SwapSlice64": func() { SwapSlice64(values) },
+		"encoding/binary": func() {
+			for i := range values {
+				values[i] = binary.BigEndian.Uint64(bytes[i*8:])
+			}
+		},
+		"ToLittleEndianGeneric": func() {
+			for i := range values {
+				values[i] = ToLittleEndianGeneric(values[i])
+			}
+		},
+	}
+
+	for name, swap := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(swapBenchmarkSize)
+			for i := 0; i < b.N; i++ {
+				swap()
+			}
+		})
+	}
+}
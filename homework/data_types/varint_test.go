@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v varint_test.go
+
+var (
+	ErrOverflow  = errors.New("varint overflows 64 bits")
+	ErrTruncated = errors.New("varint is truncated")
+)
+
+const maxVarintLen = 10
+
+// AppendUleb128 appends v in unsigned LEB128: 7 bits per byte, least
+// significant group first, the high bit set on every byte but the last.
+func AppendUleb128(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+// AppendSleb128 appends v in signed LEB128, the last group is sign extended.
+func AppendSleb128(dst []byte, v int64) []byte {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(dst, b)
+		}
+		dst = append(dst, b|0x80)
+	}
+}
+
+// Zigzag maps signed to unsigned integers so that values of small magnitude
+// stay small: 0, -1, 1, -2 become 0, 1, 2, 3.
+func Zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func Unzigzag(u uint64) int64 {
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+// AppendVarint appends v as a protobuf sint64: zigzag, then unsigned LEB128.
+func AppendVarint(dst []byte, v int64) []byte {
+	return AppendUleb128(dst, Zigzag(v))
+}
+
+// AppendPrefixVarint appends v in 1 to 9 bytes. The number of trailing zero
+// bits of the first byte is the number of bytes that follow, the value is
+// stored little endian above them. A first byte of zero is followed by the
+// whole value in 8 bytes. The length is known after the first byte, which
+// makes decoding cheaper than LEB128.
+func AppendPrefixVarint(dst []byte, v uint64) []byte {
+	n := max(1, (bits.Len64(v)+6)/7)
+	if n > 8 {
+		dst = append(dst, 0)
+		return binary.LittleEndian.AppendUint64(dst, v)
+	}
+
+	encoded := v<<n | 1<<(n-1)
+	for i := 0; i < n; i++ {
+		dst = append(dst, byte(encoded>>(8*i)))
+	}
+	return dst
+}
+
+// Uleb128 decodes a value from the start of b and returns it with the number
+// of bytes read.
+func Uleb128(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < maxVarintLen; i++ {
+		if i == len(b) {
+			return 0, 0, ErrTruncated
+		}
+
+		if i == maxVarintLen-1 && b[i] > 1 {
+			return 0, 0, ErrOverflow
+		}
+		v |= uint64(b[i]&0x7F) << (7 * i)
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, ErrOverflow
+}
+
+func Sleb128(b []byte) (int64, int, error) {
+	r := sliceReader{data: b}
+	v, err := ReadSleb128(&r)
+	if err == io.EOF {
+		// there is no stream to end, the value is missing
+		err = ErrTruncated
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return v, r.offset, nil
+}
+
+func Varint(b []byte) (int64, int, error) {
+	u, n, err := Uleb128(b)
+	return Unzigzag(u), n, err
+}
+
+func PrefixVarint(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, ErrTruncated
+	}
+
+	n := bits.TrailingZeros8(b[0]) + 1
+	if b[0] == 0 {
+		n = 9
+	}
+	if len(b) < n {
+		return 0, 0, ErrTruncated
+	}
+
+	if n == 9 {
+		return binary.LittleEndian.Uint64(b[1:]), n, nil
+	}
+	var encoded uint64
+	for i := n - 1; i >= 0; i-- {
+		encoded = encoded<<8 | uint64(b[i])
+	}
+	return encoded >> n, n, nil
+}
+
+// ReadUleb128 reads a value from a stream. It returns io.EOF if the stream
+// ends before the first byte and ErrTruncated if it ends within the value.
+func ReadUleb128(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := 0; i < maxVarintLen; i++ {
+		b, err := readByte(r, i)
+		if err != nil {
+			return 0, err
+		}
+
+		if i == maxVarintLen-1 && b > 1 {
+			return 0, ErrOverflow
+		}
+		v |= uint64(b&0x7F) << (7 * i)
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, ErrOverflow
+}
+
+func ReadSleb128(r io.ByteReader) (int64, error) {
+	var v int64
+	for i := 0; i < maxVarintLen; i++ {
+		b, err := readByte(r, i)
+		if err != nil {
+			return 0, err
+		}
+
+		if i == maxVarintLen-1 && b != 0x00 && b != 0x7F {
+			// only the sign bit is left, the group must repeat it
+			return 0, ErrOverflow
+		}
+		v |= int64(b&0x7F) << (7 * i)
+		if b < 0x80 {
+			if shift := 7 * (i + 1); shift < 64 && b&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v, nil
+		}
+	}
+	return 0, ErrOverflow
+}
+
+func ReadVarint(r io.ByteReader) (int64, error) {
+	u, err := ReadUleb128(r)
+	return Unzigzag(u), err
+}
+
+func ReadPrefixVarint(r io.ByteReader) (uint64, error) {
+	first, err := readByte(r, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	n := bits.TrailingZeros8(first) + 1
+	if first == 0 {
+		n = 9
+	}
+
+	var rest [8]byte
+	for i := 1; i < n; i++ {
+		if rest[i-1], err = readByte(r, i); err != nil {
+			return 0, err
+		}
+	}
+
+	if n == 9 {
+		return binary.LittleEndian.Uint64(rest[:]), nil
+	}
+	encoded := uint64(first) | binary.LittleEndian.Uint64(rest[:])<<8
+	return encoded >> n, nil
+}
+
+// readByte reads byte i of a value, an end of stream after the first byte
+// truncates the value.
+func readByte(r io.ByteReader, i int) (byte, error) {
+	b, err := r.ReadByte()
+	if err == io.EOF && i > 0 {
+		return 0, ErrTruncated
+	}
+	return b, err
+}
+
+type sliceReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *sliceReader) ReadByte() (byte, error) {
+	if r.offset >= len(r.data) {
+		return 0, io.EOF
+	}
+	r.offset++
+	return r.data[r.offset-1], nil
+}
+
+func TestUleb128(t *testing.T) {
+	tests := map[string]struct {
+		value   uint64
+		encoded []byte
+	}{
+		"zero":        {value: 0, encoded: []byte{0x00}},
+		"one byte":    {value: 127, encoded: []byte{0x7F}},
+		"two bytes":   {value: 128, encoded: []byte{0x80, 0x01}},
+		"dwarf":       {value: 624485, encoded: []byte{0xE5, 0x8E, 0x26}},
+		"max uint64":  {value: math.MaxUint64, encoded: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}},
+		"high bit 63": {value: 1 << 63, encoded: []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.encoded, AppendUleb128(nil, test.value))
+			assert.Equal(t, binary.AppendUvarint(nil, test.value), test.encoded)
+
+			value, n, err := Uleb128(append(test.encoded, 0xAA))
+			assert.NoError(t, err)
+			assert.Equal(t, test.value, value)
+			assert.Equal(t, len(test.encoded), n)
+		})
+	}
+}
+
+func TestSleb128(t *testing.T) {
+	tests := map[string]struct {
+		value   int64
+		encoded []byte
+	}{
+		"zero":      {value: 0, encoded: []byte{0x00}},
+		"minus one": {value: -1, encoded: []byte{0x7F}},
+		"63":        {value: 63, encoded: []byte{0x3F}},
+		"64":        {value: 64, encoded: []byte{0xC0, 0x00}},
+		"-64":       {value: -64, encoded: []byte{0x40}},
+		"-65":       {value: -65, encoded: []byte{0xBF, 0x7F}},
+		"dwarf":     {value: -123456, encoded: []byte{0xC0, 0xBB, 0x78}},
+		"max int64": {value: math.MaxInt64, encoded: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x00}},
+		"min int64": {value: math.MinInt64, encoded: []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x7F}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.encoded, AppendSleb128(nil, test.value))
+
+			value, n, err := Sleb128(test.encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, test.value, value)
+			assert.Equal(t, len(test.encoded), n)
+		})
+	}
+}
+
+func TestZigzag(t *testing.T) {
+	tests := map[int64]uint64{
+		0:             0,
+		-1:            1,
+		1:             2,
+		-2:            3,
+		math.MaxInt64: math.MaxUint64 - 1,
+		math.MinInt64: math.MaxUint64,
+	}
+
+	for value, encoded := range tests {
+		assert.Equal(t, encoded, Zigzag(value))
+		assert.Equal(t, value, Unzigzag(encoded))
+		assert.Equal(t, binary.AppendVarint(nil, value), AppendVarint(nil, value))
+	}
+}
+
+func TestPrefixVarint(t *testing.T) {
+	tests := map[string]struct {
+		value   uint64
+		encoded []byte
+	}{
+		"zero":       {value: 0, encoded: []byte{0x01}},
+		"one byte":   {value: 127, encoded: []byte{0xFF}},
+		"two bytes":  {value: 128, encoded: []byte{0x02, 0x02}},
+		"max 8":      {value: 1<<56 - 1, encoded: []byte{0x80, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		"nine bytes": {value: 1 << 56, encoded: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		"max uint64": {value: math.MaxUint64, encoded: []byte{0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.encoded, AppendPrefixVarint(nil, test.value))
+
+			value, n, err := PrefixVarint(test.encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, test.value, value)
+			assert.Equal(t, len(test.encoded), n)
+		})
+	}
+}
+
+func TestVarintRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	var buf []byte
+	values := make([]uint64, 1000)
+	for i := range values {
+		values[i] = random.Uint64() >> random.Intn(64)
+		buf = AppendUleb128(buf, values[i])
+		buf = AppendSleb128(buf, int64(values[i]))
+		buf = AppendVarint(buf, -int64(values[i]))
+		buf = AppendPrefixVarint(buf, values[i])
+	}
+
+	r := bytes.NewReader(buf)
+	for _, value := range values {
+		u, err := ReadUleb128(r)
+		assert.NoError(t, err)
+		assert.Equal(t, value, u)
+
+		s, err := ReadSleb128(r)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(value), s)
+
+		v, err := ReadVarint(r)
+		assert.NoError(t, err)
+		assert.Equal(t, -int64(value), v)
+
+		p, err := ReadPrefixVarint(r)
+		assert.NoError(t, err)
+		assert.Equal(t, value, p)
+	}
+
+	_, err := ReadUleb128(r)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestVarintErrors(t *testing.T) {
+	// a tenth byte after nine continuation bytes holds the top bit
+	nineBytes := []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80}
+
+	tests := map[string]struct {
+		decode   func([]byte) error
+		encoded  []byte
+		expected error
+	}{
+		"uleb128 empty":     {decode: decodeUleb128, encoded: nil, expected: ErrTruncated},
+		"uleb128 truncated": {decode: decodeUleb128, encoded: []byte{0x80, 0x80}, expected: ErrTruncated},
+		"uleb128 overflow":  {decode: decodeUleb128, encoded: append(nineBytes, 0x02), expected: ErrOverflow},
+		"uleb128 too long":  {decode: decodeUleb128, encoded: append(nineBytes, 0x80, 0x00), expected: ErrOverflow},
+		"sleb128 truncated": {decode: decodeSleb128, encoded: []byte{0xFF}, expected: ErrTruncated},
+		"sleb128 overflow":  {decode: decodeSleb128, encoded: append(nineBytes, 0x01), expected: ErrOverflow},
+		"varint overflow":   {decode: decodeVarint, encoded: append(nineBytes, 0x7F), expected: ErrOverflow},
+		"prefix truncated":  {decode: decodePrefixVarint, encoded: []byte{0x04, 0x01}, expected: ErrTruncated},
+		"prefix nine bytes": {decode: decodePrefixVarint, encoded: []byte{0x00, 0x01}, expected: ErrTruncated},
+		"prefix empty":      {decode: decodePrefixVarint, encoded: []byte{}, expected: ErrTruncated},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.ErrorIs(t, test.decode(test.encoded), test.expected)
+		})
+	}
+
+	// decoders report no consumed bytes on error
+	for _, encoded := range [][]byte{{0xFF}, append(nineBytes, 0x01)} {
+		v, n, err := Sleb128(encoded)
+		assert.Error(t, err)
+		assert.Zero(t, v)
+		assert.Zero(t, n)
+	}
+
+	_, err := ReadPrefixVarint(bytes.NewReader([]byte{0x02}))
+	assert.ErrorIs(t, err, ErrTruncated)
+	_, err = ReadSleb128(bytes.NewReader(nil))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func decodeUleb128(b []byte) error {
+	_, _, err := Uleb128(b)
+	return err
+}
+
+func decodeSleb128(b []byte) error {
+	_, _, err := Sleb128(b)
+	return err
+}
+
+func decodeVarint(b []byte) error {
+	_, _, err := Varint(b)
+	return err
+}
+
+func decodePrefixVarint(b []byte) error {
+	_, _, err := PrefixVarint(b)
+	return err
+}
+
+func BenchmarkVarint(b *testing.B) {
+	values := make([]uint64, 1024)
+	random := rand.New(rand.NewSource(1))
+	for i := range values {
+		values[i] = random.Uint64() >> random.Intn(64)
+	}
+
+	var leb, prefix []byte
+	for _, value := range values {
+		leb = AppendUleb128(leb, value)
+		prefix = AppendPrefixVarint(prefix, value)
+	}
+
+	b.Run("uleb128", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for offset := 0; offset < len(leb); {
+				_, n, _ := Uleb128(leb[offset:])
+				offset += n
+			}
+		}
+	})
+
+	b.Run("prefix", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for offset := 0; offset < len(prefix); {
+				_, n, _ := PrefixVarint(prefix[offset:])
+				offset += n
+			}
+		}
+	})
+
+	b.Run("encoding/binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for offset := 0; offset < len(leb); {
+				_, n := binary.Uvarint(leb[offset:])
+				offset += n
+			}
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v compact_test.go refcount_test.go homework_test.go
+
+const wordSize = unsafe.Sizeof(uintptr(0))
+
+// MovingHeap is a bump allocated region of words that is reclaimed by moving
+// live objects. Every root slot and every reachable word, including words
+// outside the region, is rewritten to the new addresses.
+type MovingHeap struct {
+	words []uintptr
+	spare []uintptr
+	top   int
+}
+
+func NewMovingHeap(size int) *MovingHeap {
+	return &MovingHeap{
+		words: newHeap(size),
+		spare: newHeap(size),
+	}
+}
+
+// Alloc places a new object holding value and returns its address.
+func (h *MovingHeap) Alloc(value uintptr) (uintptr, bool) {
+	if h.top == len(h.words) {
+		return 0, false
+	}
+
+	h.words[h.top] = value
+	h.top++
+	return addr(&h.words[h.top-1]), true
+}
+
+func (h *MovingHeap) Len() int {
+	return h.top
+}
+
+func (h *MovingHeap) Contains(ptr uintptr) bool {
+	return contains(h.words, ptr)
+}
+
+func contains(space []uintptr, ptr uintptr) bool {
+	base := addr(&space[0])
+	return ptr >= base && ptr < base+uintptr(len(space))*wordSize
+}
+
+func index(space []uintptr, ptr uintptr) int {
+	return int((ptr - addr(&space[0])) / wordSize)
+}
+
+// Compact marks with Trace and slides live objects towards the start of the
+// region keeping their address order (LISP2 style). It returns the
+// forwarding table from old to new addresses.
+func (h *MovingHeap) Compact(stacks [][]uintptr) map[uintptr]uintptr {
+	live := Trace(stacks)
+
+	var objects []int
+	for _, ptr := range live {
+		if h.Contains(ptr) {
+			objects = append(objects, index(h.words, ptr))
+		}
+	}
+	slices.Sort(objects)
+
+	forwarding := make(map[uintptr]uintptr, len(objects))
+	for to, from := range objects {
+		forwarding[addr(&h.words[from])] = addr(&h.words[to])
+	}
+
+	forward := func(ptr uintptr) uintptr {
+		if to, ok := forwarding[ptr]; ok {
+			return to
+		}
+		return ptr
+	}
+
+	for _, stack := range stacks {
+		for i := range stack {
+			stack[i] = forward(stack[i])
+		}
+	}
+
+	for _, ptr := range live {
+		*word(ptr) = forward(*word(ptr))
+	}
+
+	for to, from := range objects {
+		h.words[to] = h.words[from]
+	}
+	clear(h.words[len(objects):h.top])
+	h.top = len(objects)
+
+	return forwarding
+}
+
+// Copy evacuates live objects into the spare region with Cheney's breadth
+// first algorithm and flips the regions. It returns the forwarding table from
+// old to new addresses.
+func (h *MovingHeap) Copy(stacks [][]uintptr) map[uintptr]uintptr {
+	forwarding := map[uintptr]uintptr{}
+	visited := map[uintptr]struct{}{}
+	var outside []uintptr
+	var free int
+
+	forward := func(ptr uintptr) uintptr {
+		if ptr == 0 {
+			return 0
+		}
+
+		if !h.Contains(ptr) {
+			// objects outside the region do not move but still have to be scanned
+			if _, ok := visited[ptr]; !ok {
+				visited[ptr] = struct{}{}
+				outside = append(outside, ptr)
+			}
+			return ptr
+		}
+
+		if to, ok := forwarding[ptr]; ok {
+			return to
+		}
+
+		h.spare[free] = *word(ptr)
+		forwarding[ptr] = addr(&h.spare[free])
+		free++
+		return forwarding[ptr]
+	}
+
+	for _, stack := range stacks {
+		for i := range stack {
+			stack[i] = forward(stack[i])
+		}
+	}
+
+	for scan := 0; scan < free || len(outside) > 0; {
+		if scan < free {
+			h.spare[scan] = forward(h.spare[scan])
+			scan++
+			continue
+		}
+
+		ptr := outside[0]
+		outside = outside[1:]
+		*word(ptr) = forward(*word(ptr))
+	}
+
+	clear(h.words[:h.top])
+	h.words, h.spare = h.spare, h.words
+	h.top = free
+
+	return forwarding
+}
+
+func TestMovingHeap(t *testing.T) {
+	type collect func(h *MovingHeap, stacks [][]uintptr) map[uintptr]uintptr
+
+	tests := map[string]struct {
+		collect collect
+	}{
+		"sliding compaction": {
+			collect: (*MovingHeap).Compact,
+		},
+		"semi-space copying": {
+			collect: (*MovingHeap).Copy,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := NewMovingHeap(8)
+
+			garbage1, _ := h.Alloc(0)
+			tail, _ := h.Alloc(0)
+			garbage2, _ := h.Alloc(0)
+			head, _ := h.Alloc(tail)
+			cycle1, _ := h.Alloc(0)
+			cycle2, _ := h.Alloc(cycle1)
+			*word(cycle1) = cycle2
+			h.Alloc(garbage1)
+
+			outside := newHeap(1)
+			outside[0] = cycle2
+
+			stacks := [][]uintptr{
+				{head, 0x00, addr(&outside[0])},
+				{0x00, tail},
+			}
+
+			before := len(Trace(stacks))
+			forwarding := test.collect(h, stacks)
+
+			assert.Equal(t, 4, h.Len())
+			assert.Len(t, forwarding, 4)
+			assert.NotContains(t, forwarding, garbage1)
+			assert.NotContains(t, forwarding, garbage2)
+
+			// roots and interior pointers follow the objects
+			head, tail = stacks[0][0], stacks[1][1]
+			assert.True(t, h.Contains(head))
+			assert.Equal(t, tail, *word(head))
+			assert.Equal(t, uintptr(0), *word(tail))
+			assert.Equal(t, addr(&outside[0]), stacks[0][2])
+
+			cycle2 = outside[0]
+			assert.True(t, h.Contains(cycle2))
+			cycle1 = *word(cycle2)
+			assert.True(t, h.Contains(cycle1))
+			assert.Equal(t, cycle2, *word(cycle1))
+
+			assert.Len(t, Trace(stacks), before)
+			for _, ptr := range Trace(stacks) {
+				if h.Contains(ptr) {
+					assert.Less(t, index(h.words, ptr), h.Len())
+				}
+			}
+
+			// freed space is reusable
+			for i := h.Len(); i < 8; i++ {
+				_, ok := h.Alloc(0)
+				assert.True(t, ok)
+			}
+			_, ok := h.Alloc(0)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestCompactKeepsAddressOrder(t *testing.T) {
+	h := NewMovingHeap(6)
+
+	var objects []uintptr
+	for range 6 {
+		ptr, _ := h.Alloc(0)
+		objects = append(objects, ptr)
+	}
+
+	stacks := [][]uintptr{
+		{objects[5], objects[1], objects[3]},
+	}
+
+	forwarding := h.Compact(stacks)
+	assert.Equal(t, map[uintptr]uintptr{
+		objects[1]: objects[0],
+		objects[3]: objects[1],
+		objects[5]: objects[2],
+	}, forwarding)
+	assert.Equal(t, []uintptr{objects[2], objects[0], objects[1]}, stacks[0])
+}
+
+func TestCopyBreadthFirst(t *testing.T) {
+	h := NewMovingHeap(4)
+
+	c, _ := h.Alloc(0)
+	b, _ := h.Alloc(c)
+	a, _ := h.Alloc(b)
+
+	stacks := [][]uintptr{
+		{a},
+	}
+
+	forwarding := h.Copy(stacks)
+	assert.Equal(t, addr(&h.words[0]), forwarding[a])
+	assert.Equal(t, addr(&h.words[1]), forwarding[b])
+	assert.Equal(t, addr(&h.words[2]), forwarding[c])
+	assert.Equal(t, []uintptr{forwarding[b], forwarding[c], 0, 0}, h.words)
+	assert.Equal(t, []uintptr{0, 0, 0, 0}, h.spare)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v heapdump_test.go refcount_test.go homework_test.go
+
+// HeapDump records how every pointer visited by Trace was reached.
+type HeapDump struct {
+	Roots   []HeapRoot
+	Objects []HeapObject
+	index   map[uintptr]int
+}
+
+// HeapRoot is a non-zero stack slot.
+type HeapRoot struct {
+	Stack  int
+	Slot   int
+	Target uintptr
+}
+
+// HeapObject is a visited heap word. Stack and Slot identify the root the
+// object was first reached from, Parent is the object that led to it or zero
+// when the root points at the object directly.
+type HeapObject struct {
+	Address uintptr
+	Pointer uintptr
+	Stack   int
+	Slot    int
+	Parent  uintptr
+}
+
+// HeapPath is a chain of pointers from a root slot down to an object.
+type HeapPath struct {
+	Stack    int
+	Slot     int
+	Pointers []uintptr
+}
+
+func Dump(stacks [][]uintptr) *HeapDump {
+	dump := &HeapDump{index: map[uintptr]int{}}
+
+	for i, stack := range stacks {
+		for j, ptr := range stack {
+			if ptr == 0 {
+				continue
+			}
+
+			dump.Roots = append(dump.Roots, HeapRoot{Stack: i, Slot: j, Target: ptr})
+
+			var parent uintptr
+			for ptr != 0 {
+				if _, ok := dump.index[ptr]; ok {
+					break
+				}
+
+				dump.index[ptr] = len(dump.Objects)
+				dump.Objects = append(dump.Objects, HeapObject{
+					Address: ptr,
+					Pointer: *word(ptr),
+					Stack:   i,
+					Slot:    j,
+					Parent:  parent,
+				})
+				parent, ptr = ptr, *word(ptr)
+			}
+		}
+	}
+
+	return dump
+}
+
+// Pointers returns visited addresses in the same order as Trace.
+func (d *HeapDump) Pointers() []uintptr {
+	result := make([]uintptr, 0, len(d.Objects))
+	for _, object := range d.Objects {
+		result = append(result, object.Address)
+	}
+	return result
+}
+
+func (d *HeapDump) Object(ptr uintptr) (HeapObject, bool) {
+	i, ok := d.index[ptr]
+	if !ok {
+		return HeapObject{}, false
+	}
+	return d.Objects[i], true
+}
+
+// PathToRoot explains why ptr is reachable. The returned pointers start at
+// the object referenced by the root and end at ptr.
+func (d *HeapDump) PathToRoot(ptr uintptr) (HeapPath, bool) {
+	object, ok := d.Object(ptr)
+	if !ok {
+		return HeapPath{}, false
+	}
+
+	path := HeapPath{Stack: object.Stack, Slot: object.Slot}
+	for {
+		path.Pointers = append(path.Pointers, object.Address)
+		if object.Parent == 0 {
+			break
+		}
+		object, _ = d.Object(object.Parent)
+	}
+	slices.Reverse(path.Pointers)
+
+	return path, true
+}
+
+func (d *HeapDump) WriteDOT(w io.Writer) error {
+	b := bytes.Buffer{}
+	b.WriteString("digraph heap {\n")
+
+	for _, root := range d.Roots {
+		name := fmt.Sprintf("stack%d[%d]", root.Stack, root.Slot)
+		fmt.Fprintf(&b, "\t%q [shape=box];\n", name)
+		fmt.Fprintf(&b, "\t%q -> %q;\n", name, hex(root.Target))
+	}
+
+	for _, object := range d.Objects {
+		fmt.Fprintf(&b, "\t%q;\n", hex(object.Address))
+		if object.Pointer != 0 {
+			fmt.Fprintf(&b, "\t%q -> %q;\n", hex(object.Address), hex(object.Pointer))
+		}
+	}
+
+	b.WriteString("}\n")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+type dtoHeapDump struct {
+	Roots   []dtoHeapRoot   `json:"roots"`
+	Objects []dtoHeapObject `json:"objects"`
+}
+
+type dtoHeapRoot struct {
+	Stack  int    `json:"stack"`
+	Slot   int    `json:"slot"`
+	Target string `json:"target"`
+}
+
+type dtoHeapObject struct {
+	Address string `json:"address"`
+	Pointer string `json:"pointer,omitempty"`
+	Stack   int    `json:"stack"`
+	Slot    int    `json:"slot"`
+	Parent  string `json:"parent,omitempty"`
+}
+
+func (d *HeapDump) MarshalJSON() ([]byte, error) {
+	dto := dtoHeapDump{
+		Roots:   make([]dtoHeapRoot, 0, len(d.Roots)),
+		Objects: make([]dtoHeapObject, 0, len(d.Objects)),
+	}
+
+	for _, root := range d.Roots {
+		dto.Roots = append(dto.Roots, dtoHeapRoot{
+			Stack:  root.Stack,
+			Slot:   root.Slot,
+			Target: hex(root.Target),
+		})
+	}
+
+	for _, object := range d.Objects {
+		dto.Objects = append(dto.Objects, dtoHeapObject{
+			Address: hex(object.Address),
+			Pointer: hex(object.Pointer),
+			Stack:   object.Stack,
+			Slot:    object.Slot,
+			Parent:  hex(object.Parent),
+		})
+	}
+
+	return json.Marshal(dto)
+}
+
+func hex(ptr uintptr) string {
+	if ptr == 0 {
+		return ""
+	}
+	return fmt.Sprintf("0x%x", ptr)
+}
+
+func TestDump(t *testing.T) {
+	heap := newHeap(5)
+
+	heap[0] = addr(&heap[1])
+	heap[1] = addr(&heap[2])
+	heap[3] = addr(&heap[1])
+
+	stacks := [][]uintptr{
+		{0x00, addr(&heap[0])},
+		{addr(&heap[3]), 0x00, addr(&heap[4])},
+	}
+
+	dump := Dump(stacks)
+	assert.Equal(t, Trace(stacks), dump.Pointers())
+
+	assert.Equal(t, []HeapRoot{
+		{Stack: 0, Slot: 1, Target: addr(&heap[0])},
+		{Stack: 1, Slot: 0, Target: addr(&heap[3])},
+		{Stack: 1, Slot: 2, Target: addr(&heap[4])},
+	}, dump.Roots)
+
+	object, ok := dump.Object(addr(&heap[2]))
+	assert.True(t, ok)
+	assert.Equal(t, HeapObject{
+		Address: addr(&heap[2]),
+		Stack:   0,
+		Slot:    1,
+		Parent:  addr(&heap[1]),
+	}, object)
+
+	object, ok = dump.Object(addr(&heap[3]))
+	assert.True(t, ok)
+	assert.Equal(t, HeapObject{
+		Address: addr(&heap[3]),
+		Pointer: addr(&heap[1]),
+		Stack:   1,
+		Slot:    0,
+	}, object)
+}
+
+func TestPathToRoot(t *testing.T) {
+	heap := newHeap(4)
+
+	heap[0] = addr(&heap[1])
+	heap[1] = addr(&heap[2])
+	heap[2] = addr(&heap[0])
+
+	stacks := [][]uintptr{
+		{0x00, 0x00},
+		{0x00, addr(&heap[0])},
+	}
+
+	dump := Dump(stacks)
+
+	tests := map[string]struct {
+		ptr  uintptr
+		ok   bool
+		path HeapPath
+	}{
+		"object referenced by root": {
+			ptr:  addr(&heap[0]),
+			ok:   true,
+			path: HeapPath{Stack: 1, Slot: 1, Pointers: []uintptr{addr(&heap[0])}},
+		},
+		"object inside cycle": {
+			ptr: addr(&heap[2]),
+			ok:  true,
+			path: HeapPath{Stack: 1, Slot: 1, Pointers: []uintptr{
+				addr(&heap[0]), addr(&heap[1]), addr(&heap[2]),
+			}},
+		},
+		"unreachable object": {
+			ptr: addr(&heap[3]),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			path, ok := dump.PathToRoot(test.ptr)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.path, path)
+		})
+	}
+}
+
+func TestDumpExport(t *testing.T) {
+	heap := newHeap(2)
+	heap[0] = addr(&heap[1])
+
+	stacks := [][]uintptr{
+		{addr(&heap[0]), addr(&heap[1])},
+	}
+
+	dump := Dump(stacks)
+	a, b := hex(addr(&heap[0])), hex(addr(&heap[1]))
+
+	dot := bytes.Buffer{}
+	assert.NoError(t, dump.WriteDOT(&dot))
+	assert.Equal(t, "digraph heap {\n"+
+		"\t\"stack0[0]\" [shape=box];\n"+
+		"\t\"stack0[0]\" -> \""+a+"\";\n"+
+		"\t\"stack0[1]\" [shape=box];\n"+
+		"\t\"stack0[1]\" -> \""+b+"\";\n"+
+		"\t\""+a+"\";\n"+
+		"\t\""+a+"\" -> \""+b+"\";\n"+
+		"\t\""+b+"\";\n"+
+		"}\n", dot.String())
+
+	data, err := json.Marshal(dump)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"roots": [
+			{"stack": 0, "slot": 0, "target": "`+a+`"},
+			{"stack": 0, "slot": 1, "target": "`+b+`"}
+		],
+		"objects": [
+			{"address": "`+a+`", "pointer": "`+b+`", "stack": 0, "slot": 0},
+			{"address": "`+b+`", "stack": 0, "slot": 0, "parent": "`+a+`"}
+		]
+	}`, string(data))
+}
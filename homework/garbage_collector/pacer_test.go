@@ -0,0 +1,407 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v pacer_test.go
+
+const (
+	defaultMinHeap  = 4 << 20
+	defaultScanRate = 1 << 30 // bytes marked per second
+
+	// the trigger always leaves 5% to 30% of the runway between the live heap
+	// and the goal, as in the Go runtime pacer
+	minTriggerPercent = 70
+	maxTriggerPercent = 95
+)
+
+// PacerConfig mirrors the GOGC and GOMEMLIMIT knobs of the Go runtime.
+type PacerConfig struct {
+	GOGC        int   // heap growth percent, negative disables proportional pacing
+	MemoryLimit int64 // soft limit in bytes, zero means no limit
+	MinHeap     int64 // smallest heap goal at GOGC=100, 4 MiB by default
+	ScanRate    int64 // bytes marked per second, 1 GiB/s by default
+}
+
+type Pacer struct {
+	config PacerConfig
+}
+
+func NewPacer(config PacerConfig) *Pacer {
+	if config.MinHeap == 0 {
+		config.MinHeap = defaultMinHeap
+	}
+	if config.ScanRate == 0 {
+		config.ScanRate = defaultScanRate
+	}
+	return &Pacer{config: config}
+}
+
+// Goal returns the heap size the next cycle should finish at.
+func (p *Pacer) Goal(live int64) int64 {
+	goal := int64(math.MaxInt64)
+	if p.config.GOGC >= 0 {
+		goal = max(live+live*int64(p.config.GOGC)/100, p.config.MinHeap*int64(p.config.GOGC)/100)
+	}
+	if p.config.MemoryLimit > 0 {
+		goal = min(goal, p.config.MemoryLimit)
+	}
+	return goal
+}
+
+// Trigger returns the heap size at which the next cycle has to start so that
+// marking finishes before the goal, given the current allocation rate in
+// bytes per second.
+func (p *Pacer) Trigger(live int64, allocRate float64) int64 {
+	goal := p.Goal(live)
+	if goal == math.MaxInt64 {
+		return goal
+	}
+	if goal <= live {
+		return live
+	}
+
+	runway := int64(allocRate * p.MarkDuration(live).Seconds())
+	growth := goal - live
+	lower := live + growth*minTriggerPercent/100
+	upper := live + growth*maxTriggerPercent/100
+
+	return min(max(goal-runway, lower), upper)
+}
+
+// MarkDuration returns how long marking a live heap takes.
+func (p *Pacer) MarkDuration(live int64) time.Duration {
+	return time.Duration(float64(live) / float64(p.config.ScanRate) * float64(time.Second))
+}
+
+// WorkloadPhase allocates at a constant rate while the live heap changes
+// linearly towards Live.
+type WorkloadPhase struct {
+	Duration  time.Duration
+	AllocRate int64 // bytes per second
+	Live      int64
+}
+
+type HeapSample struct {
+	Time    time.Duration
+	Heap    int64
+	Live    int64
+	Goal    int64
+	Trigger int64
+	Marking bool
+}
+
+type GCCycle struct {
+	Start         time.Duration
+	End           time.Duration
+	Live          int64
+	HeapAtTrigger int64
+	HeapAtEnd     int64
+	Goal          int64
+}
+
+type Timeline struct {
+	Samples []HeapSample
+	Cycles  []GCCycle
+}
+
+// Simulate runs the workload with a fixed time step and records the heap
+// after every step together with all GC cycles. A phase whose duration is
+// not a multiple of step ends with a shorter step, so the live heap always
+// reaches the Live of the phase, a phase of zero duration sets the live heap
+// at once. It panics if step is not positive.
+func (p *Pacer) Simulate(workload []WorkloadPhase, step time.Duration) Timeline {
+	if step <= 0 {
+		panic("step must be positive")
+	}
+
+	var timeline Timeline
+	var now time.Duration
+	var live, heap int64
+
+	goal := p.Goal(live)
+	trigger := p.Trigger(live, 0)
+
+	var cycle *GCCycle
+	var lastCycleEnd time.Duration
+	var allocatedSinceCycle, allocatedDuringMark int64
+
+	for _, phase := range workload {
+		startLive := live
+		if phase.Duration <= 0 {
+			live = phase.Live
+			heap = max(heap, live)
+		}
+
+		for elapsed := time.Duration(0); elapsed < phase.Duration; {
+			delta := min(step, phase.Duration-elapsed)
+			elapsed += delta
+			now += delta
+			live = startLive + int64(float64(phase.Live-startLive)*float64(elapsed)/float64(phase.Duration))
+
+			// rate times nanoseconds overflows int64, so scale in floating point
+			allocated := int64(float64(phase.AllocRate) * delta.Seconds())
+			heap = max(heap+allocated, live)
+			allocatedSinceCycle += allocated
+
+			if cycle != nil {
+				allocatedDuringMark += allocated
+				if heap >= cycle.Goal {
+					// mutator assists throttle allocation and finish marking at the
+					// goal, unless the live heap alone already exceeds it
+					heap = max(cycle.Goal, live)
+					cycle.End = now
+				}
+				if now >= cycle.End {
+					// objects allocated while marking are retained until the next
+					// cycle, and the heap never shrinks below the current live heap
+					heap = min(heap, max(cycle.Live+allocatedDuringMark, live))
+					cycle.HeapAtEnd = heap
+					timeline.Cycles = append(timeline.Cycles, *cycle)
+
+					allocRate := float64(allocatedSinceCycle) / (now - lastCycleEnd).Seconds()
+					goal = p.Goal(cycle.Live)
+					trigger = p.Trigger(cycle.Live, allocRate)
+
+					cycle = nil
+					lastCycleEnd = now
+					allocatedSinceCycle = 0
+				}
+			} else if heap >= trigger {
+				cycle = &GCCycle{
+					Start:         now,
+					End:           now + max(p.MarkDuration(live), step),
+					Live:          live,
+					HeapAtTrigger: heap,
+					Goal:          goal,
+				}
+				allocatedDuringMark = 0
+			}
+
+			timeline.Samples = append(timeline.Samples, HeapSample{
+				Time:    now,
+				Heap:    heap,
+				Live:    live,
+				Goal:    goal,
+				Trigger: trigger,
+				Marking: cycle != nil,
+			})
+		}
+	}
+
+	return timeline
+}
+
+func (t Timeline) PeakHeap() int64 {
+	var peak int64
+	for _, sample := range t.Samples {
+		peak = max(peak, sample.Heap)
+	}
+	return peak
+}
+
+// MarkFraction returns the share of the simulated time spent marking. Each
+// sample covers the time since the previous one.
+func (t Timeline) MarkFraction() float64 {
+	if len(t.Samples) == 0 || t.Samples[len(t.Samples)-1].Time == 0 {
+		return 0
+	}
+
+	var marking, previous time.Duration
+	for _, sample := range t.Samples {
+		if sample.Marking {
+			marking += sample.Time - previous
+		}
+		previous = sample.Time
+	}
+	return float64(marking) / float64(t.Samples[len(t.Samples)-1].Time)
+}
+
+func TestPacerGoal(t *testing.T) {
+	const mb = 1 << 20
+
+	tests := map[string]struct {
+		config PacerConfig
+		live   int64
+		goal   int64
+	}{
+		"default GOGC doubles live heap": {
+			config: PacerConfig{GOGC: 100},
+			live:   10 * mb,
+			goal:   20 * mb,
+		},
+		"GOGC 50": {
+			config: PacerConfig{GOGC: 50},
+			live:   10 * mb,
+			goal:   15 * mb,
+		},
+		"minimum heap": {
+			config: PacerConfig{GOGC: 100},
+			live:   1 * mb,
+			goal:   4 * mb,
+		},
+		"minimum heap scales with GOGC": {
+			config: PacerConfig{GOGC: 200},
+			live:   1 * mb,
+			goal:   8 * mb,
+		},
+		"memory limit caps the goal": {
+			config: PacerConfig{GOGC: 100, MemoryLimit: 12 * mb},
+			live:   10 * mb,
+			goal:   12 * mb,
+		},
+		"GOGC off with memory limit": {
+			config: PacerConfig{GOGC: -1, MemoryLimit: 64 * mb},
+			live:   10 * mb,
+			goal:   64 * mb,
+		},
+		"GOGC off without memory limit": {
+			config: PacerConfig{GOGC: -1},
+			live:   10 * mb,
+			goal:   math.MaxInt64,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.goal, NewPacer(test.config).Goal(test.live))
+		})
+	}
+}
+
+func TestPacerTrigger(t *testing.T) {
+	const mb = 1 << 20
+	pacer := NewPacer(PacerConfig{GOGC: 100, ScanRate: 100 * mb})
+
+	// marking 10 MiB takes 100ms, 20 MiB/s of allocation needs a 2 MiB runway
+	assert.Equal(t, 100*time.Millisecond, pacer.MarkDuration(10*mb))
+	assert.Equal(t, int64(18*mb), pacer.Trigger(10*mb, 20*mb))
+
+	// runway is clamped to the trigger bounds
+	assert.Equal(t, int64(17*mb), pacer.Trigger(10*mb, 1000*mb))
+	assert.Equal(t, int64(19*mb+512*1024), pacer.Trigger(10*mb, 0))
+
+	limited := NewPacer(PacerConfig{GOGC: 100, MemoryLimit: 8 * mb})
+	assert.Equal(t, int64(10*mb), limited.Trigger(10*mb, 20*mb))
+}
+
+func TestPacerSimulate(t *testing.T) {
+	const mb = 1 << 20
+
+	workload := []WorkloadPhase{
+		{Duration: 2 * time.Second, AllocRate: 50 * mb, Live: 32 * mb},
+		{Duration: 4 * time.Second, AllocRate: 100 * mb, Live: 32 * mb},
+		{Duration: 2 * time.Second, AllocRate: 25 * mb, Live: 8 * mb},
+	}
+	step := 10 * time.Millisecond
+
+	simulate := func(config PacerConfig) Timeline {
+		config.ScanRate = 256 * mb
+		return NewPacer(config).Simulate(workload, step)
+	}
+
+	gogc100 := simulate(PacerConfig{GOGC: 100})
+	assert.Len(t, gogc100.Samples, 800)
+	assert.Equal(t, gogc100, simulate(PacerConfig{GOGC: 100}))
+
+	for _, cycle := range gogc100.Cycles {
+		assert.GreaterOrEqual(t, cycle.HeapAtTrigger, cycle.Live)
+		assert.LessOrEqual(t, cycle.HeapAtEnd, cycle.Goal)
+		assert.Greater(t, cycle.End, cycle.Start)
+	}
+
+	gogc50 := simulate(PacerConfig{GOGC: 50})
+	gogc200 := simulate(PacerConfig{GOGC: 200})
+	assert.Greater(t, len(gogc50.Cycles), len(gogc100.Cycles))
+	assert.Greater(t, len(gogc100.Cycles), len(gogc200.Cycles))
+	assert.Less(t, gogc50.PeakHeap(), gogc100.PeakHeap())
+	assert.Less(t, gogc100.PeakHeap(), gogc200.PeakHeap())
+	assert.Greater(t, gogc50.MarkFraction(), gogc200.MarkFraction())
+
+	limited := simulate(PacerConfig{GOGC: 200, MemoryLimit: 48 * mb})
+	assert.LessOrEqual(t, limited.PeakHeap(), int64(48*mb))
+	assert.Greater(t, len(limited.Cycles), len(gogc200.Cycles))
+
+	off := simulate(PacerConfig{GOGC: -1})
+	assert.Empty(t, off.Cycles)
+	assert.Equal(t, int64(50*2+100*4+25*2)*mb, off.PeakHeap())
+}
+
+func TestPacerSimulateGrowingLiveHeap(t *testing.T) {
+	const mb = 1 << 20
+
+	// without allocation the heap is exactly the live heap, which keeps
+	// growing while a cycle marks
+	workload := []WorkloadPhase{{Duration: time.Second, Live: 100 * mb}}
+	timeline := NewPacer(PacerConfig{GOGC: 100}).Simulate(workload, 10*time.Millisecond)
+
+	assert.NotEmpty(t, timeline.Cycles)
+	for _, sample := range timeline.Samples {
+		assert.Equal(t, sample.Live, sample.Heap)
+	}
+}
+
+func TestPacerSimulateStep(t *testing.T) {
+	workload := []WorkloadPhase{{Duration: time.Second, AllocRate: 1 << 20}}
+	assert.Panics(t, func() { NewPacer(PacerConfig{GOGC: 100}).Simulate(workload, 0) })
+	assert.Panics(t, func() { NewPacer(PacerConfig{GOGC: 100}).Simulate(workload, -time.Millisecond) })
+}
+
+func TestPacerSimulatePartialStep(t *testing.T) {
+	const mb = 1 << 20
+
+	workload := []WorkloadPhase{
+		{Duration: 25 * time.Millisecond, Live: 1 * mb},
+		{Duration: 10 * time.Millisecond, Live: 1 * mb},
+	}
+	timeline := NewPacer(PacerConfig{GOGC: -1}).Simulate(workload, 10*time.Millisecond)
+
+	var times []time.Duration
+	for _, sample := range timeline.Samples {
+		times = append(times, sample.Time)
+	}
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 25 * time.Millisecond, 35 * time.Millisecond}, times)
+	assert.Equal(t, int64(1*mb), timeline.Samples[2].Live)
+	assert.Equal(t, int64(1*mb), timeline.Samples[3].Live)
+}
+
+func TestPacerSimulateInstantPhase(t *testing.T) {
+	const mb = 1 << 20
+
+	workload := []WorkloadPhase{
+		{Live: 4 * mb},
+		{Duration: 20 * time.Millisecond, Live: 4 * mb},
+	}
+	timeline := NewPacer(PacerConfig{GOGC: -1}).Simulate(workload, 10*time.Millisecond)
+
+	assert.Len(t, timeline.Samples, 2)
+	for _, sample := range timeline.Samples {
+		assert.Equal(t, int64(4*mb), sample.Live)
+		assert.Equal(t, int64(4*mb), sample.Heap)
+	}
+}
+
+func TestTimelineMarkFraction(t *testing.T) {
+	// the last sample covers a partial step of 5ms
+	timeline := Timeline{Samples: []HeapSample{
+		{Time: 10 * time.Millisecond, Marking: true},
+		{Time: 20 * time.Millisecond},
+		{Time: 25 * time.Millisecond, Marking: true},
+	}}
+	assert.InDelta(t, 0.6, timeline.MarkFraction(), 1e-9)
+	assert.Zero(t, Timeline{}.MarkFraction())
+}
+
+func TestPacerSimulateLargeRate(t *testing.T) {
+	const gb = 1 << 30
+
+	workload := []WorkloadPhase{{Duration: 2 * time.Second, AllocRate: 10 * gb}}
+	timeline := NewPacer(PacerConfig{GOGC: -1}).Simulate(workload, time.Second)
+
+	assert.Equal(t, int64(20*gb), timeline.PeakHeap())
+}
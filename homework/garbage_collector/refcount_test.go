@@ -0,0 +1,398 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v refcount_test.go homework_test.go
+
+// RefCounter is a reference counting collector over the same heap model as
+// Trace: every object is a single word that either holds zero or the address
+// of another object. Garbage cycles are reclaimed by synchronous trial
+// deletion (Bacon & Rajan, "Concurrent Cycle Collection in Reference Counted
+// Systems", 2001).
+type RefCounter struct {
+	objects    map[uintptr]*rcObject
+	candidates []uintptr
+	freed      []uintptr
+}
+
+type rcColor int
+
+const (
+	rcBlack  rcColor = iota // in use or free
+	rcGray                  // possible member of a cycle
+	rcWhite                 // member of a garbage cycle
+	rcPurple                // possible root of a cycle
+)
+
+type rcObject struct {
+	count    int
+	color    rcColor
+	buffered bool
+}
+
+// NewRefCounter builds reference counts from the root slots in stacks and the
+// pointers stored in heap. Objects that are not reachable from any root must
+// be listed in heap, otherwise the collector never learns about them. Every
+// object starts as a cycle candidate, so the first Collect reclaims garbage
+// that existed before the snapshot.
+func NewRefCounter(stacks [][]uintptr, heap []uintptr) *RefCounter {
+	rc := &RefCounter{objects: map[uintptr]*rcObject{}}
+
+	for _, ptr := range heap {
+		rc.track(ptr)
+	}
+
+	for _, stack := range stacks {
+		for _, ptr := range stack {
+			rc.Retain(ptr)
+		}
+	}
+
+	for ptr, obj := range rc.objects {
+		obj.color = rcPurple
+		obj.buffered = true
+		rc.candidates = append(rc.candidates, ptr)
+	}
+	slices.Sort(rc.candidates)
+
+	return rc
+}
+
+func (rc *RefCounter) track(ptr uintptr) {
+	if ptr == 0 {
+		return
+	}
+
+	if _, ok := rc.objects[ptr]; ok {
+		return
+	}
+
+	rc.objects[ptr] = &rcObject{}
+	if child := *word(ptr); child != 0 {
+		rc.track(child)
+		rc.objects[child].count++
+	}
+}
+
+// Retain records a new reference to ptr from outside the heap, e.g. from a
+// stack slot.
+func (rc *RefCounter) Retain(ptr uintptr) {
+	if ptr == 0 {
+		return
+	}
+
+	rc.track(ptr)
+	rc.increment(ptr)
+}
+
+// Release drops a reference to ptr from outside the heap. Objects whose count
+// reaches zero are freed immediately, the others become cycle candidates.
+func (rc *RefCounter) Release(ptr uintptr) {
+	rc.decrement(ptr)
+}
+
+// Store writes value into the heap object at slot, adjusting reference counts
+// for both the new and the overwritten pointer.
+func (rc *RefCounter) Store(slot, value uintptr) {
+	rc.increment(value)
+	old := *word(slot)
+	*word(slot) = value
+	rc.decrement(old)
+}
+
+// Collect runs cycle collection and returns every object freed since the
+// previous call, including the ones freed by Release and Store.
+func (rc *RefCounter) Collect() []uintptr {
+	rc.markCandidates()
+	for _, ptr := range rc.candidates {
+		rc.scan(ptr)
+	}
+	rc.collectCandidates()
+
+	freed := rc.freed
+	rc.freed = nil
+	return freed
+}
+
+// Live returns the addresses of all objects that have not been freed yet.
+func (rc *RefCounter) Live() []uintptr {
+	result := make([]uintptr, 0, len(rc.objects))
+	for ptr := range rc.objects {
+		result = append(result, ptr)
+	}
+	slices.Sort(result)
+
+	return result
+}
+
+// Count returns the current reference count of ptr.
+func (rc *RefCounter) Count(ptr uintptr) int {
+	if obj, ok := rc.objects[ptr]; ok {
+		return obj.count
+	}
+	return 0
+}
+
+func (rc *RefCounter) child(ptr uintptr) (uintptr, bool) {
+	child := *word(ptr)
+	if _, ok := rc.objects[child]; !ok {
+		return 0, false
+	}
+	return child, true
+}
+
+func (rc *RefCounter) increment(ptr uintptr) {
+	if obj, ok := rc.objects[ptr]; ok {
+		obj.count++
+		obj.color = rcBlack
+	}
+}
+
+func (rc *RefCounter) decrement(ptr uintptr) {
+	obj, ok := rc.objects[ptr]
+	if !ok {
+		return
+	}
+
+	obj.count--
+	if obj.count == 0 {
+		rc.release(ptr, obj)
+		return
+	}
+	rc.possibleRoot(ptr, obj)
+}
+
+func (rc *RefCounter) release(ptr uintptr, obj *rcObject) {
+	if child, ok := rc.child(ptr); ok {
+		rc.decrement(child)
+	}
+
+	obj.color = rcBlack
+	if !obj.buffered {
+		rc.free(ptr)
+	}
+}
+
+func (rc *RefCounter) possibleRoot(ptr uintptr, obj *rcObject) {
+	if obj.color == rcPurple {
+		return
+	}
+
+	obj.color = rcPurple
+	if !obj.buffered {
+		obj.buffered = true
+		rc.candidates = append(rc.candidates, ptr)
+	}
+}
+
+func (rc *RefCounter) free(ptr uintptr) {
+	delete(rc.objects, ptr)
+	rc.freed = append(rc.freed, ptr)
+}
+
+func (rc *RefCounter) markCandidates() {
+	candidates := rc.candidates[:0]
+	for _, ptr := range rc.candidates {
+		obj, ok := rc.objects[ptr]
+		if !ok {
+			continue
+		}
+
+		if obj.color == rcPurple {
+			rc.markGray(ptr)
+			candidates = append(candidates, ptr)
+			continue
+		}
+
+		obj.buffered = false
+		if obj.color == rcBlack && obj.count == 0 {
+			rc.free(ptr)
+		}
+	}
+	rc.candidates = candidates
+}
+
+func (rc *RefCounter) markGray(ptr uintptr) {
+	obj := rc.objects[ptr]
+	if obj.color == rcGray {
+		return
+	}
+
+	obj.color = rcGray
+	if child, ok := rc.child(ptr); ok {
+		rc.objects[child].count--
+		rc.markGray(child)
+	}
+}
+
+func (rc *RefCounter) scan(ptr uintptr) {
+	obj, ok := rc.objects[ptr]
+	if !ok || obj.color != rcGray {
+		return
+	}
+
+	if obj.count > 0 {
+		rc.scanBlack(ptr)
+		return
+	}
+
+	obj.color = rcWhite
+	if child, ok := rc.child(ptr); ok {
+		rc.scan(child)
+	}
+}
+
+func (rc *RefCounter) scanBlack(ptr uintptr) {
+	rc.objects[ptr].color = rcBlack
+	if child, ok := rc.child(ptr); ok {
+		obj := rc.objects[child]
+		obj.count++
+		if obj.color != rcBlack {
+			rc.scanBlack(child)
+		}
+	}
+}
+
+func (rc *RefCounter) collectCandidates() {
+	candidates := rc.candidates
+	rc.candidates = nil
+
+	for _, ptr := range candidates {
+		if obj, ok := rc.objects[ptr]; ok {
+			obj.buffered = false
+		}
+	}
+
+	for _, ptr := range candidates {
+		rc.collectWhite(ptr)
+	}
+}
+
+func (rc *RefCounter) collectWhite(ptr uintptr) {
+	obj, ok := rc.objects[ptr]
+	if !ok || obj.color != rcWhite || obj.buffered {
+		return
+	}
+
+	obj.color = rcBlack
+	child, hasChild := rc.child(ptr)
+	rc.free(ptr)
+	if hasChild {
+		rc.collectWhite(child)
+	}
+}
+
+// newHeap allocates words on the Go heap: a stack allocated array may be moved
+// when the goroutine stack grows, invalidating addresses kept as uintptr.
+//
+//go:noinline
+func newHeap(size int) []uintptr {
+	return make([]uintptr, size)
+}
+
+func addr(ptr *uintptr) uintptr {
+	return uintptr(unsafe.Pointer(ptr))
+}
+
+// word returns the object at address ptr, converted as unpack does.
+func word(ptr uintptr) *uintptr {
+	return (*uintptr)(unsafe.Pointer(ptr))
+}
+
+func TestRefCounterMatchesTrace(t *testing.T) {
+	heap := newHeap(8)
+
+	heap[0] = addr(&heap[1]) // live chain
+	heap[2] = addr(&heap[3]) // garbage cycle
+	heap[3] = addr(&heap[2])
+	heap[4] = addr(&heap[4]) // garbage self loop
+	heap[6] = addr(&heap[7]) // live cycle
+	heap[7] = addr(&heap[6])
+
+	objects := make([]uintptr, len(heap))
+	for i := range heap {
+		objects[i] = addr(&heap[i])
+	}
+
+	stacks := [][]uintptr{
+		{addr(&heap[0]), 0x00, 0x00, 0x00},
+		{0x00, 0x00, addr(&heap[6]), addr(&heap[0])},
+	}
+
+	rc := NewRefCounter(stacks, objects)
+	assert.Equal(t, 2, rc.Count(addr(&heap[0])))
+	assert.Equal(t, 2, rc.Count(addr(&heap[6])))
+
+	freed := rc.Collect()
+	assert.ElementsMatch(t, []uintptr{
+		addr(&heap[2]), addr(&heap[3]), addr(&heap[4]), addr(&heap[5]),
+	}, freed)
+	assert.ElementsMatch(t, Trace(stacks), rc.Live())
+
+	// counts are restored after trial deletion
+	assert.Equal(t, 2, rc.Count(addr(&heap[0])))
+	assert.Equal(t, 1, rc.Count(addr(&heap[1])))
+	assert.Equal(t, 2, rc.Count(addr(&heap[6])))
+	assert.Equal(t, 1, rc.Count(addr(&heap[7])))
+}
+
+func TestRefCounterRelease(t *testing.T) {
+	heap := newHeap(4)
+
+	heap[0] = addr(&heap[1])
+	heap[2] = addr(&heap[3])
+	heap[3] = addr(&heap[2])
+
+	stacks := [][]uintptr{
+		{addr(&heap[0]), addr(&heap[2])},
+	}
+
+	rc := NewRefCounter(stacks, nil)
+	assert.Empty(t, rc.Collect())
+
+	// acyclic chain is freed without cycle collection
+	stacks[0][0] = 0
+	rc.Release(addr(&heap[0]))
+	assert.ElementsMatch(t, []uintptr{addr(&heap[0]), addr(&heap[1])}, rc.Collect())
+	assert.ElementsMatch(t, Trace(stacks), rc.Live())
+
+	// cycle is kept by its internal references until trial deletion
+	stacks[0][1] = 0
+	rc.Release(addr(&heap[2]))
+	assert.Equal(t, 1, rc.Count(addr(&heap[2])))
+	assert.ElementsMatch(t, []uintptr{addr(&heap[2]), addr(&heap[3])}, rc.Collect())
+	assert.ElementsMatch(t, Trace(stacks), rc.Live())
+}
+
+func TestRefCounterStore(t *testing.T) {
+	heap := newHeap(3)
+
+	heap[0] = addr(&heap[1])
+	heap[1] = addr(&heap[2])
+	heap[2] = addr(&heap[1])
+
+	stacks := [][]uintptr{
+		{addr(&heap[0])},
+	}
+
+	rc := NewRefCounter(stacks, nil)
+	assert.Empty(t, rc.Collect())
+
+	// detaching a cycle from its only external reference
+	rc.Store(addr(&heap[0]), 0)
+	assert.Equal(t, uintptr(0), heap[0])
+	assert.ElementsMatch(t, []uintptr{addr(&heap[1]), addr(&heap[2])}, rc.Collect())
+	assert.ElementsMatch(t, Trace(stacks), rc.Live())
+
+	// self loop on a rooted object survives collection
+	rc.Store(addr(&heap[0]), addr(&heap[0]))
+	assert.Empty(t, rc.Collect())
+	assert.Equal(t, 2, rc.Count(addr(&heap[0])))
+	assert.ElementsMatch(t, Trace(stacks), rc.Live())
+}
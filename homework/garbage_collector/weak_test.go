@@ -0,0 +1,334 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v weak_test.go refcount_test.go homework_test.go
+
+// Collector is a mark-sweep collector built on Trace that supports weak
+// handles and finalizers with the same semantics as the Go runtime:
+//   - weak handles are cleared as soon as their target is unreachable from the
+//     roots, before any finalizer runs;
+//   - an unreachable object with a finalizer and everything it points to are
+//     resurrected for one more cycle, the finalizer is queued and removed, so
+//     the memory is reclaimed by the next cycle at the earliest;
+//   - objects reachable from another finalizer are not finalized in the same
+//     cycle, which is why cycles of finalizers are never collected.
+//
+// Finalizers run one at a time on a dedicated goroutine and may call
+// SetFinalizer and MakeWeak themselves.
+type Collector struct {
+	mu         sync.Mutex
+	heap       map[uintptr]struct{}
+	weak       []*WeakHandle
+	finalizers map[uintptr]func(ptr uintptr)
+	closed     bool
+
+	queue   []func()
+	ready   *sync.Cond // signaled when a finalizer is queued or on Close
+	pending sync.WaitGroup
+	done    chan struct{}
+}
+
+type WeakHandle struct {
+	ptr atomic.Uintptr
+}
+
+// Value returns the target of the handle or zero once it has been collected.
+func (h *WeakHandle) Value() uintptr {
+	return h.ptr.Load()
+}
+
+func NewCollector(heap []uintptr) *Collector {
+	c := &Collector{
+		heap:       map[uintptr]struct{}{},
+		finalizers: map[uintptr]func(ptr uintptr){},
+		done:       make(chan struct{}),
+	}
+	c.ready = sync.NewCond(&c.mu)
+
+	for _, ptr := range heap {
+		c.heap[ptr] = struct{}{}
+	}
+
+	go c.runFinalizers()
+
+	return c
+}
+
+func (c *Collector) runFinalizers() {
+	defer close(c.done)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		for len(c.queue) == 0 && !c.closed {
+			c.ready.Wait()
+		}
+		if len(c.queue) == 0 {
+			return
+		}
+
+		finalizer := c.queue[0]
+		c.queue = c.queue[1:]
+
+		// finalizers may register other finalizers
+		c.mu.Unlock()
+		finalizer()
+		c.pending.Done()
+		c.mu.Lock()
+	}
+}
+
+// Close stops the finalizer goroutine after it drained the queue. Collect
+// does nothing once the collector is closed.
+func (c *Collector) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	c.ready.Signal()
+	<-c.done
+}
+
+// WaitFinalizers blocks until every queued finalizer has returned.
+func (c *Collector) WaitFinalizers() {
+	c.pending.Wait()
+}
+
+func (c *Collector) MakeWeak(ptr uintptr) *WeakHandle {
+	handle := &WeakHandle{}
+	handle.ptr.Store(ptr)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.weak = append(c.weak, handle)
+	return handle
+}
+
+// SetFinalizer registers finalizer for ptr, nil removes the registration.
+func (c *Collector) SetFinalizer(ptr uintptr, finalizer func(ptr uintptr)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if finalizer == nil {
+		delete(c.finalizers, ptr)
+		return
+	}
+	c.finalizers[ptr] = finalizer
+}
+
+// Collect marks from stacks and returns the objects that were reclaimed.
+func (c *Collector) Collect(stacks [][]uintptr) []uintptr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	marked := map[uintptr]struct{}{}
+	for _, ptr := range Trace(stacks) {
+		marked[ptr] = struct{}{}
+	}
+
+	c.clearWeak(marked)
+
+	var unreachable []uintptr
+	for ptr := range c.finalizers {
+		if _, ok := marked[ptr]; !ok {
+			unreachable = append(unreachable, ptr)
+		}
+	}
+	slices.Sort(unreachable)
+
+	for _, ptr := range unreachable {
+		unpack(*word(ptr), marked)
+	}
+
+	for _, ptr := range unreachable {
+		if _, ok := marked[ptr]; ok {
+			continue
+		}
+
+		marked[ptr] = struct{}{}
+		finalizer := c.finalizers[ptr]
+		delete(c.finalizers, ptr)
+
+		c.pending.Add(1)
+		c.queue = append(c.queue, func() { finalizer(ptr) })
+		c.ready.Signal()
+	}
+
+	var freed []uintptr
+	for ptr := range c.heap {
+		if _, ok := marked[ptr]; !ok {
+			delete(c.heap, ptr)
+			freed = append(freed, ptr)
+		}
+	}
+	slices.Sort(freed)
+
+	return freed
+}
+
+func (c *Collector) clearWeak(marked map[uintptr]struct{}) {
+	handles := c.weak[:0]
+	for _, handle := range c.weak {
+		if _, ok := marked[handle.Value()]; ok {
+			handles = append(handles, handle)
+			continue
+		}
+		handle.ptr.Store(0)
+	}
+	c.weak = handles
+}
+
+func TestWeakHandle(t *testing.T) {
+	heap := newHeap(3)
+	heap[0] = addr(&heap[1])
+
+	stacks := [][]uintptr{
+		{addr(&heap[0])},
+	}
+
+	c := NewCollector([]uintptr{addr(&heap[0]), addr(&heap[1]), addr(&heap[2])})
+	defer c.Close()
+
+	cache := map[string]*WeakHandle{
+		"reachable":   c.MakeWeak(addr(&heap[1])),
+		"unreachable": c.MakeWeak(addr(&heap[2])),
+	}
+
+	assert.Equal(t, []uintptr{addr(&heap[2])}, c.Collect(stacks))
+	assert.Equal(t, addr(&heap[1]), cache["reachable"].Value())
+	assert.Zero(t, cache["unreachable"].Value())
+
+	stacks[0][0] = 0
+	assert.Equal(t, []uintptr{addr(&heap[0]), addr(&heap[1])}, c.Collect(stacks))
+	assert.Zero(t, cache["reachable"].Value())
+}
+
+func TestFinalizerDelaysReclamation(t *testing.T) {
+	heap := newHeap(2)
+	heap[0] = addr(&heap[1])
+
+	c := NewCollector([]uintptr{addr(&heap[0]), addr(&heap[1])})
+	defer c.Close()
+
+	weak := c.MakeWeak(addr(&heap[0]))
+
+	var finalized []uintptr
+	c.SetFinalizer(addr(&heap[0]), func(ptr uintptr) {
+		finalized = append(finalized, ptr)
+	})
+
+	stacks := [][]uintptr{{0x00}}
+
+	// first cycle resurrects the object and everything it references
+	assert.Empty(t, c.Collect(stacks))
+	c.WaitFinalizers()
+	assert.Equal(t, []uintptr{addr(&heap[0])}, finalized)
+	assert.Zero(t, weak.Value())
+
+	// finalizer has run, the next cycle reclaims the memory
+	assert.Equal(t, []uintptr{addr(&heap[0]), addr(&heap[1])}, c.Collect(stacks))
+	c.WaitFinalizers()
+	assert.Len(t, finalized, 1)
+}
+
+func TestFinalizerResurrection(t *testing.T) {
+	heap := newHeap(1)
+
+	c := NewCollector([]uintptr{addr(&heap[0])})
+	defer c.Close()
+
+	stacks := [][]uintptr{{0x00}}
+	c.SetFinalizer(addr(&heap[0]), func(ptr uintptr) {
+		stacks[0][0] = ptr
+	})
+
+	assert.Empty(t, c.Collect(stacks))
+	c.WaitFinalizers()
+
+	// finalizer stored the object in a root, it stays alive without a finalizer
+	assert.Empty(t, c.Collect(stacks))
+
+	stacks[0][0] = 0
+	assert.Equal(t, []uintptr{addr(&heap[0])}, c.Collect(stacks))
+}
+
+func TestFinalizerOrdering(t *testing.T) {
+	heap := newHeap(4)
+	heap[0] = addr(&heap[1]) // chain of finalizers
+	heap[2] = addr(&heap[3]) // cycle of finalizers
+	heap[3] = addr(&heap[2])
+
+	c := NewCollector([]uintptr{addr(&heap[0]), addr(&heap[1]), addr(&heap[2]), addr(&heap[3])})
+	defer c.Close()
+
+	var mu sync.Mutex
+	var finalized []uintptr
+	finalizer := func(ptr uintptr) {
+		mu.Lock()
+		defer mu.Unlock()
+		finalized = append(finalized, ptr)
+	}
+	for i := range heap {
+		c.SetFinalizer(addr(&heap[i]), finalizer)
+	}
+
+	stacks := [][]uintptr{{0x00}}
+	var freed []uintptr
+	for cycle := 0; cycle < 4; cycle++ {
+		freed = append(freed, c.Collect(stacks)...)
+		c.WaitFinalizers()
+	}
+
+	// the head of the chain is finalized before the object it references,
+	// the cycle keeps itself alive forever
+	assert.Equal(t, []uintptr{addr(&heap[0]), addr(&heap[1])}, finalized)
+	assert.Equal(t, []uintptr{addr(&heap[0]), addr(&heap[1])}, freed)
+}
+
+func TestFinalizerSetsFinalizer(t *testing.T) {
+	heap := newHeap(1)
+
+	c := NewCollector([]uintptr{addr(&heap[0])})
+	defer c.Close()
+
+	// the finalizer keeps the object alive and registers itself again, so it
+	// runs once per cycle
+	var runs atomic.Int32
+	var finalizer func(ptr uintptr)
+	finalizer = func(ptr uintptr) {
+		runs.Add(1)
+		c.SetFinalizer(ptr, finalizer)
+	}
+	c.SetFinalizer(addr(&heap[0]), finalizer)
+
+	stacks := [][]uintptr{{0x00}}
+	for range 3 {
+		assert.Empty(t, c.Collect(stacks))
+		c.WaitFinalizers()
+	}
+	assert.Equal(t, int32(3), runs.Load())
+}
+
+func TestCollectAfterClose(t *testing.T) {
+	heap := newHeap(1)
+
+	c := NewCollector([]uintptr{addr(&heap[0])})
+	c.SetFinalizer(addr(&heap[0]), func(ptr uintptr) {})
+	c.Close()
+
+	assert.Nil(t, c.Collect([][]uintptr{{0x00}}))
+	c.Close()
+}
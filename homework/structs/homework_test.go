@@ -105,45 +105,69 @@ const (
 	personTypeBits   = 3
 )
 
+var ErrFieldOverflow = errors.New("value does not fit its bit field")
+
+// saturate clamps value to the range of an unsigned bit field, setBits would
+// drop the high bits instead.
+func saturate(value, bits int) uint64 {
+	return uint64(min(max(value, 0), 1<<bits-1))
+}
+
+// checkField returns ErrFieldOverflow if value does not fit an unsigned bit
+// field, the checked options use it instead of clamping.
+func checkField(name string, value, bits int) error {
+	if value < 0 || value > 1<<bits-1 {
+		return fmt.Errorf("%s %d: %w", name, value, ErrFieldOverflow)
+	}
+	return nil
+}
+
+// WithGold clamps gold to [0, 2^31-1], see WithGoldChecked.
 func WithGold(gold int) func(*GamePerson) {
 	return func(person *GamePerson) {
-		setBits(&person.attributes, goldOffset, goldBits, uint64(gold))
+		setBits(&person.attributes, goldOffset, goldBits, saturate(gold, goldBits))
 	}
 }
 
+// WithMana clamps mana to [0, 1023], see WithManaChecked.
 func WithMana(mana int) func(*GamePerson) {
 	return func(person *GamePerson) {
-		setBits(&person.attributes, manaOffset, manaBits, uint64(mana))
+		setBits(&person.attributes, manaOffset, manaBits, saturate(mana, manaBits))
 	}
 }
 
+// WithHealth clamps health to [0, 1023], see WithHealthChecked.
 func WithHealth(health int) func(*GamePerson) {
 	return func(person *GamePerson) {
-		setBits(&person.attributes, healthOffset, healthBits, uint64(health))
+		setBits(&person.attributes, healthOffset, healthBits, saturate(health, healthBits))
 	}
 }
 
+// WithRespect clamps respect to [0, 15], see WithRespectChecked.
 func WithRespect(respect int) func(*GamePerson) {
 	return func(person *GamePerson) {
-		setBits(&person.attributes, respectOffset, respectBits, uint64(respect))
+		setBits(&person.attributes, respectOffset, respectBits, saturate(respect, respectBits))
 	}
 }
 
+// WithStrength clamps strength to [0, 15], see WithStrengthChecked.
 func WithStrength(strength int) func(*GamePerson) {
 	return func(person *GamePerson) {
-		setBits(&person.attributes, strengthOffset, strengthBits, uint64(strength))
+		setBits(&person.attributes, strengthOffset, strengthBits, saturate(strength, strengthBits))
 	}
 }
 
+// WithExperience clamps experience to [0, 15], see WithExperienceChecked.
 func WithExperience(experience int) func(*GamePerson) {
 	return func(person *GamePerson) {
-		setBits(&person.attributes, experienceOffset, experienceBits, uint64(experience))
+		setBits(&person.attributes, experienceOffset, experienceBits, saturate(experience, experienceBits))
 	}
 }
 
+// WithLevel clamps level to [0, 15], see WithLevelChecked.
 func WithLevel(level int) func(*GamePerson) {
 	return func(person *GamePerson) {
-		setBits(&person.attributes, levelOffset, levelBits, uint64(level))
+		setBits(&person.attributes, levelOffset, levelBits, saturate(level, levelBits))
 	}
 }
 
@@ -165,10 +189,69 @@ func WithFamily() func(*GamePerson) {
 	}
 }
 
+// WithType clamps personType to [0, 7], see WithTypeChecked.
 func WithType(personType int) func(*GamePerson) {
 	return func(person *GamePerson) {
-		setBits(&person.attributes, personTypeOffset, personTypeBits, uint64(personType))
+		setBits(&person.attributes, personTypeOffset, personTypeBits, saturate(personType, personTypeBits))
+	}
+}
+
+// WithGoldChecked is WithGold that returns ErrFieldOverflow instead of
+// clamping gold, so do the other checked options.
+func WithGoldChecked(gold int) (Option, error) {
+	if err := checkField("gold", gold, goldBits); err != nil {
+		return nil, err
+	}
+	return WithGold(gold), nil
+}
+
+func WithManaChecked(mana int) (Option, error) {
+	if err := checkField("mana", mana, manaBits); err != nil {
+		return nil, err
+	}
+	return WithMana(mana), nil
+}
+
+func WithHealthChecked(health int) (Option, error) {
+	if err := checkField("health", health, healthBits); err != nil {
+		return nil, err
+	}
+	return WithHealth(health), nil
+}
+
+func WithRespectChecked(respect int) (Option, error) {
+	if err := checkField("respect", respect, respectBits); err != nil {
+		return nil, err
+	}
+	return WithRespect(respect), nil
+}
+
+func WithStrengthChecked(strength int) (Option, error) {
+	if err := checkField("strength", strength, strengthBits); err != nil {
+		return nil, err
 	}
+	return WithStrength(strength), nil
+}
+
+func WithExperienceChecked(experience int) (Option, error) {
+	if err := checkField("experience", experience, experienceBits); err != nil {
+		return nil, err
+	}
+	return WithExperience(experience), nil
+}
+
+func WithLevelChecked(level int) (Option, error) {
+	if err := checkField("level", level, levelBits); err != nil {
+		return nil, err
+	}
+	return WithLevel(level), nil
+}
+
+func WithTypeChecked(personType int) (Option, error) {
+	if err := checkField("type", personType, personTypeBits); err != nil {
+		return nil, err
+	}
+	return WithType(personType), nil
 }
 
 const (
@@ -355,6 +438,62 @@ func TestGamePerson(t *testing.T) {
 	fmt.Println(string(b2))
 }
 
+func TestGamePersonSaturates(t *testing.T) {
+	tests := map[string]struct {
+		option   Option
+		value    func(*GamePerson) int
+		expected int
+	}{
+		"gold above range":  {option: WithGold(math.MaxInt32 + 1), value: (*GamePerson).Gold, expected: math.MaxInt32},
+		"negative gold":     {option: WithGold(-1), value: (*GamePerson).Gold, expected: 0},
+		"mana above range":  {option: WithMana(5000), value: (*GamePerson).Mana, expected: 1023},
+		"level above range": {option: WithLevel(16), value: (*GamePerson).Level, expected: 15},
+		"type above range":  {option: WithType(8), value: (*GamePerson).Type, expected: 7},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			person := NewGamePerson(test.option, WithHealth(1000))
+			assert.Equal(t, test.expected, test.value(&person))
+			assert.Equal(t, 1000, person.Health())
+		})
+	}
+}
+
+func TestGamePersonChecked(t *testing.T) {
+	tests := map[string]struct {
+		option func(int) (Option, error)
+		value  int
+		err    string
+	}{
+		"gold":           {option: WithGoldChecked, value: math.MaxInt32},
+		"gold overflow":  {option: WithGoldChecked, value: math.MaxInt32 + 1, err: "gold 2147483648: value does not fit its bit field"},
+		"negative mana":  {option: WithManaChecked, value: -1, err: "mana -1: value does not fit its bit field"},
+		"health":         {option: WithHealthChecked, value: 1023},
+		"level overflow": {option: WithLevelChecked, value: 16, err: "level 16: value does not fit its bit field"},
+		"type overflow":  {option: WithTypeChecked, value: 8, err: "type 8: value does not fit its bit field"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			option, err := test.option(test.value)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				assert.ErrorIs(t, err, ErrFieldOverflow)
+				assert.Nil(t, option)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotNil(t, option)
+		})
+	}
+
+	gold, err := WithGoldChecked(1 << 20)
+	assert.NoError(t, err)
+	person := NewGamePerson(gold)
+	assert.Equal(t, 1<<20, person.Gold())
+}
+
 func MarshalJSON(v interface{}) ([]byte, error) {
 	val := reflect.ValueOf(v)
 	typ := reflect.TypeOf(v)